@@ -16,12 +16,13 @@ import (
 
 // APIResponse represents a single IP geolocation record
 type APIResponse struct {
-	IP           string  `json:"query"`
-	Country      string  `json:"country"`
-	Latitude     float64 `json:"lat"`
-	Longitude    float64 `json:"lon"`
-	RequestCount int     `json:"request_count"` // Request count for individual IP
-	ThreatLevel  int     `json:"threat_level"`  // Threat level for the IP
+	IP           string   `json:"query"`
+	Country      string   `json:"country"`
+	Latitude     float64  `json:"lat"`
+	Longitude    float64  `json:"lon"`
+	RequestCount int      `json:"request_count"`         // Request count for individual IP
+	ThreatLevel  int      `json:"threat_level"`          // Threat level for the IP
+	Honeytokens  []string `json:"honeytokens,omitempty"` // IDs of the honeytokens this IP reused
 }
 
 // CountryData aggregates data for a country
@@ -86,6 +87,7 @@ func fetchGeoData(apiURL string, ip string) (string, error) { // Return the coun
 
 	// Set the IP for the response
 	apiResponse.IP = ip
+	apiResponse.Honeytokens = ipTokens[ip]
 
 	threatLevelThreshold := config.ThreatLevelThreshold
 
@@ -118,9 +120,13 @@ func fetchGeoData(apiURL string, ip string) (string, error) { // Return the coun
 	return apiResponse.Country, nil
 }
 
-// parseLogs reads .log files, extracts IP addresses, and stores them with timestamps
+// parseLogs reads .log files, extracts IP addresses, and stores them with timestamps.
+// Lines with a honeytoken of the data generator link the IPs on them to that token.
 func parseLogs(logFiles []string) error {
 	ipRegex := regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`)
+	if err := loadHoneytokens(honeytokenRegistry); err != nil {
+		log.Printf("Honeytokens not loaded: %v", err)
+	}
 	for _, logFile := range logFiles {
 		file, err := os.Open(logFile)
 		if err != nil {
@@ -139,6 +145,7 @@ func parseLogs(logFiles []string) error {
 				// Increment the request count for the IP
 				ipCounts[ip]++
 			}
+			matchHoneytokens(logFile, line, ipMatches)
 		}
 		if err := scanner.Err(); err != nil {
 			return fmt.Errorf("error reading log file %s: %w", logFile, err)
@@ -176,6 +183,11 @@ func calculateThreatLevel(ip string, country string, failedAttempts int) int {
 	reputation := getIPReputation(ip)
 	threatLevel += reputation
 
+	// Reusing data harvested from the honeypots proves intent
+	if len(ipTokens[ip]) > 0 {
+		threatLevel += honeytokenThreat
+	}
+
 	// Geolocation-based threat scoring (high-risk countries)
 	if country == "Russia" || country == "China" {
 		threatLevel += 25
@@ -326,6 +338,7 @@ func pointsHandler(w http.ResponseWriter, r *http.Request) {
 	for _, ip := range ipData {
 		// Set the request count for each IP
 		ip.RequestCount = ipCounts[ip.IP]
+		ip.Honeytokens = ipTokens[ip.IP]
 
 		response = append(response, ip)
 	}
@@ -470,6 +483,7 @@ func main() {
 	http.HandleFunc("/countries", countriesHandler)
 	http.HandleFunc("/reload", reloadHandler)
 	http.HandleFunc("/threats", threatsHandler) // Add the threats endpoint
+	http.HandleFunc("/honeytokens", honeytokensHandler)
 
 	// Serve static files
 	http.Handle("/", http.FileServer(http.Dir("./static")))
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// honeytokenRegistry is where the data generator keeps the tokens it planted
+const honeytokenRegistry = "/logs/honeytokens.json"
+
+// honeytokenThreat is added to the threat level of an IP that reused a honeytoken
+const honeytokenThreat = 50
+
+// Honeytoken mirrors a token of the data generator registry
+type Honeytoken struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	Device   string `json:"device"`
+	Value    string `json:"value"`
+	Username string `json:"username,omitempty"`
+}
+
+// TokenHit links a honeytoken to an IP that used it in traffic to a honeypot
+type TokenHit struct {
+	TokenID string    `json:"token_id"`
+	Kind    string    `json:"kind"`
+	Device  string    `json:"device"` // the device the token was harvested from
+	IP      string    `json:"ip"`
+	LogFile string    `json:"log_file"`
+	Line    string    `json:"line"`
+	Seen    time.Time `json:"seen"`
+}
+
+var (
+	honeytokens = []Honeytoken{}
+	tokenHits   = []TokenHit{}
+	seenHits    = map[string]bool{}     // token, IP and line of every hit, logs are parsed again on every reload
+	ipTokens    = map[string][]string{} // token IDs reused by each IP
+)
+
+// loadHoneytokens reads the registry of the data generator, a missing registry means no tokens were planted
+func loadHoneytokens(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading honeytoken registry: %w", err)
+	}
+	var tokens []Honeytoken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("error parsing honeytoken registry: %w", err)
+	}
+	honeytokens = tokens
+	return nil
+}
+
+// tokenUsed reports whether a log line contains a honeytoken, as text or hex
+// encoded the way the Modbus honeypot logs raw requests
+func tokenUsed(t Honeytoken, line string) bool {
+	if t.Value != "" && (strings.Contains(line, t.Value) || strings.Contains(line, hex.EncodeToString([]byte(t.Value)))) {
+		return true
+	}
+	return t.Username != "" && strings.Contains(line, t.Username)
+}
+
+// matchHoneytokens records a hit for every honeytoken in a log line and every
+// outside IP on it. The generator itself publishes the tokens from an excluded IP.
+func matchHoneytokens(logFile, line string, ips []string) {
+	for _, t := range honeytokens {
+		if !tokenUsed(t, line) {
+			continue
+		}
+		for _, ip := range ips {
+			key := t.ID + " " + ip + " " + line
+			if isExcluded(ip) || seenHits[key] {
+				continue
+			}
+			seenHits[key] = true
+			tokenHits = append(tokenHits, TokenHit{TokenID: t.ID, Kind: t.Kind, Device: t.Device, IP: ip, LogFile: logFile, Line: line, Seen: time.Now()})
+			if !containsString(ipTokens[ip], t.ID) {
+				ipTokens[ip] = append(ipTokens[ip], t.ID)
+			}
+			log.Printf("Honeytoken %s (%s of %s) reused by %s in %s", t.ID, t.Kind, t.Device, ip, logFile)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// honeytokensHandler serves every honeytoken reuse, optionally only those of ?ip=
+func honeytokensHandler(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	hits := []TokenHit{}
+	for _, hit := range tokenHits {
+		if ip == "" || hit.IP == ip {
+			hits = append(hits, hit)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hits)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Thresholds used to decide that a source is being used as a reflection victim.
+// CoAP runs over UDP so the "source" of a request can be spoofed; a burst of
+// requests answered with more than they carried, of discovery queries or a high
+// response/request byte ratio from one address usually means someone is aiming
+// our answers at a third party. Readings published with PUT or POST are answered
+// with a bare code, so the data generator never counts toward the rate.
+const (
+	amplificationWindow       = 10 * time.Second
+	amplificationMaxRequests  = 20
+	amplificationMaxDiscovery = 3
+	amplificationMaxRatio     = 8.0
+	amplificationMinRatioReqs = 10
+	amplificationIdleExpiry   = 5 * time.Minute
+)
+
+// sourceStats holds the counters for a single remote IP inside the current window
+type sourceStats struct {
+	windowStart  time.Time
+	lastSeen     time.Time
+	requests     int
+	gets         int // GET requests, the only ones whose answers are worth reflecting
+	lastRequest  int // size of the last request, to tell which response amplifies
+	amplified    int // responses larger than the request they answer
+	discovery    int
+	bytesIn      int
+	bytesOut     int
+	suspicious   bool
+	reason       string
+	lastReported time.Time
+}
+
+// amplificationGuard tracks per-source request patterns and caps responses for suspicious sources
+type amplificationGuard struct {
+	mu      sync.Mutex
+	sources map[string]*sourceStats
+}
+
+func newAmplificationGuard() *amplificationGuard {
+	return &amplificationGuard{sources: make(map[string]*sourceStats)}
+}
+
+// hostOf strips the port from a remote address so counters are kept per IP
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// observeRequest records an incoming request and reports whether the source is now considered suspicious.
+// Only responses larger than their request count toward the rate, see recordResponse,
+// and only GET requests toward the response ratio.
+func (g *amplificationGuard) observeRequest(victim string, size int, get, discovery bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	s, ok := g.sources[victim]
+	if !ok || now.Sub(s.windowStart) > amplificationWindow {
+		next := &sourceStats{windowStart: now}
+		if ok {
+			// A flagged source stays flagged until it goes quiet and is expired
+			next.suspicious = s.suspicious
+			next.reason = s.reason
+			next.lastReported = s.lastReported
+		}
+		s = next
+		g.sources[victim] = s
+	}
+	s.lastSeen = now
+	s.requests++
+	s.lastRequest = size
+	if get {
+		s.gets++
+		s.bytesIn += size
+	}
+	if discovery {
+		s.discovery++
+	}
+
+	var reasons []string
+	if s.amplified > amplificationMaxRequests {
+		reasons = append(reasons, "request_rate")
+	}
+	if s.discovery > amplificationMaxDiscovery {
+		reasons = append(reasons, "repeated_discovery")
+	}
+	// A single discovery is always "amplified", only judge the ratio once a pattern emerges
+	if s.gets >= amplificationMinRatioReqs && ratio(s.bytesOut, s.bytesIn) > amplificationMaxRatio {
+		reasons = append(reasons, "response_ratio")
+	}
+	if len(reasons) > 0 {
+		s.suspicious = true
+		s.reason = strings.Join(reasons, ",")
+	}
+
+	// Only report once per window so a flood does not turn into a log flood
+	if s.suspicious && now.Sub(s.lastReported) > amplificationWindow {
+		s.lastReported = now
+		logEvent("amplification_attempt", victim, "victim=%s reason=%s requests=%d amplified=%d gets=%d discovery=%d bytes_in=%d bytes_out=%d ratio=%.2f",
+			victim, s.reason, s.requests, s.amplified, s.gets, s.discovery, s.bytesIn, s.bytesOut, ratio(s.bytesOut, s.bytesIn))
+	}
+
+	return s.suspicious
+}
+
+// responseLimit returns the maximum payload size we are willing to send back to a source.
+// A negative value means no limit applies.
+func (g *amplificationGuard) responseLimit(victim string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s, ok := g.sources[victim]
+	if !ok || !s.suspicious {
+		return -1
+	}
+	if s.gets == 0 {
+		return 0
+	}
+	// Never answer a suspicious source with more than the average size of its GET requests
+	return s.bytesIn / s.gets
+}
+
+// recordResponse adds the size of a response to the counters of a source and
+// counts it toward the rate when it is larger than the request it answers.
+// The source is judged on its next request.
+func (g *amplificationGuard) recordResponse(victim string, size int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if s, ok := g.sources[victim]; ok {
+		s.bytesOut += size
+		if size > s.lastRequest {
+			s.amplified++
+		}
+	}
+}
+
+// isSuspicious reports whether the source is currently flagged
+func (g *amplificationGuard) isSuspicious(victim string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s, ok := g.sources[victim]
+	return ok && s.suspicious
+}
+
+// expire periodically drops sources that have been idle for a while, so spoofed floods cannot grow the map forever
+func (g *amplificationGuard) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		g.mu.Lock()
+		for victim, s := range g.sources {
+			if time.Since(s.lastSeen) > amplificationIdleExpiry {
+				delete(g.sources, victim)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+func ratio(out, in int) float64 {
+	if in == 0 {
+		return 0
+	}
+	return float64(out) / float64(in)
+}
+
+// capPayload truncates a payload to the given limit, a negative limit leaves it untouched
+func capPayload(payload []byte, limit int) []byte {
+	if limit < 0 || len(payload) <= limit {
+		return payload
+	}
+	return payload[:limit]
+}
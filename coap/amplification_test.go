@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+// exchange is one request of a source and the payload it is answered with, -1 for a bare code
+type exchange struct {
+	size      int
+	get       bool
+	discovery bool
+	response  int
+}
+
+func TestAmplificationGuard(t *testing.T) {
+	repeat := func(n int, e exchange) []exchange {
+		exchanges := make([]exchange, n)
+		for i := range exchanges {
+			exchanges[i] = e
+		}
+		return exchanges
+	}
+
+	tests := []struct {
+		name      string
+		exchanges []exchange
+		want      bool
+		reason    string
+	}{
+		{
+			name:      "steady PUT stream of the generator",
+			exchanges: repeat(200, exchange{size: 180, response: -1}),
+		},
+		{
+			name:      "GETs answered with less than they carry",
+			exchanges: repeat(50, exchange{size: 40, get: true, response: 30}),
+		},
+		{
+			name:      "GETs answered with more than they carry",
+			exchanges: repeat(22, exchange{size: 20, get: true, response: 60}),
+			want:      true,
+			reason:    "request_rate",
+		},
+		{
+			name:      "repeated discovery",
+			exchanges: repeat(4, exchange{size: 20, get: true, discovery: true, response: 100}),
+			want:      true,
+			reason:    "repeated_discovery",
+		},
+		{
+			name:      "response ratio",
+			exchanges: repeat(11, exchange{size: 20, get: true, response: 200}),
+			want:      true,
+			reason:    "response_ratio",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newAmplificationGuard()
+			suspicious := false
+			for _, e := range tt.exchanges {
+				suspicious = g.observeRequest("10.10.0.50", e.size, e.get, e.discovery)
+				if e.response >= 0 {
+					g.recordResponse("10.10.0.50", e.response)
+				}
+			}
+			if suspicious != tt.want {
+				t.Fatalf("observeRequest() = %v, want %v", suspicious, tt.want)
+			}
+			if reason := g.sources["10.10.0.50"].reason; reason != tt.reason {
+				t.Errorf("reason = %q, want %q", reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestAmplificationLimit(t *testing.T) {
+	g := newAmplificationGuard()
+	if limit := g.responseLimit("192.0.2.1"); limit != -1 {
+		t.Errorf("responseLimit() of an unknown source = %d, want -1", limit)
+	}
+	for i := 0; i < 4; i++ {
+		g.observeRequest("192.0.2.1", 30, true, true)
+		g.recordResponse("192.0.2.1", 30+i)
+	}
+	if limit := g.responseLimit("192.0.2.1"); limit != 30 {
+		t.Errorf("responseLimit() of a flagged source = %d, want the average GET of 30", limit)
+	}
+}
@@ -2,18 +2,49 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 
-	coap "github.com/plgd-dev/go-coap/v3"
 	"github.com/plgd-dev/go-coap/v3/message"
 	"github.com/plgd-dev/go-coap/v3/message/codes"
 	"github.com/plgd-dev/go-coap/v3/mux"
+	coapNet "github.com/plgd-dev/go-coap/v3/net"
+	"github.com/plgd-dev/go-coap/v3/options"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	"github.com/plgd-dev/go-coap/v3/udp/coder"
 )
 
+var (
+	enableMulticast  = flag.Bool("multicast", false, "Join the All-CoAP-Nodes multicast groups and answer local discovery")
+	multicastLeisure = flag.Duration("leisure", 5*time.Second, "Upper bound of the random delay before answering a multicast request")
+	enableProxy      = flag.Bool("proxy", false, "Pretend to be a CoAP forward proxy for Proxy-Uri and Proxy-Scheme requests")
+)
+
+// wellKnownCore is the CoRE resource discovery path, the usual target of reflection attacks
+const wellKnownCore = "/.well-known/core"
+
+// resourceLinks is the link-format answer to a discovery query, deliberately the size a real device would return
+const resourceLinks = `</sensors/temp>;rt="temperature-c";if="sensor";ct="0 50 60 110 112";obs,` +
+	`</sensors/humidity>;rt="humidity-p";if="sensor";ct="0 50 60 110 112";obs,` +
+	`</sensors/pressure>;rt="pressure-kpa";if="sensor";ct="0 50 60 110 112";obs,` +
+	`</actuators/valve>;rt="valve";if="actuator";ct="0 50 60 110 112",` +
+	`</status>;rt="status";if="core.rp";ct="0 50 60 110 112";obs,` +
+	`</firmware>;rt="firmware";if="core.rp";ct="0 50 60 110 112"`
+
+var guard = newAmplificationGuard()
+
+// discoveryLinks returns every link advertised in /.well-known/core
+func discoveryLinks() []string {
+	links := strings.Split(resourceLinks, ",")
+	links = append(links, strings.Split(lwm2mLinks(), ",")...)
+	return append(links, deviceLinks()...)
+}
+
 func getPath(opts message.Options) string {
 	path, err := opts.Path()
 	if err != nil {
@@ -23,24 +54,75 @@ func getPath(opts message.Options) string {
 	return path
 }
 
-func sendResponse(cc mux.Conn, token []byte, subded time.Time, obs int64) error {
+// logEvent writes a single key=value event line so it can be picked up by the log pipeline
+func logEvent(event string, source string, format string, args ...interface{}) {
+	log.Printf("event=%s src=%s %s", event, source, fmt.Sprintf(format, args...))
+}
+
+// requestSize returns the size of the request on the wire, used to compute amplification ratios
+func requestSize(r *mux.Message) int {
+	data, err := r.MarshalWithEncoder(coder.DefaultCoder)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// writeCode sends a response without payload
+func writeCode(cc mux.Conn, token []byte, code codes.Code) error {
 	m := cc.AcquireMessage(cc.Context())
 	defer cc.ReleaseMessage(m)
-	m.SetCode(codes.Content)
+	m.SetCode(code)
 	m.SetToken(token)
-	m.SetBody(bytes.NewReader([]byte(fmt.Sprintf("Been running for %v", time.Since(subded)))))
-	m.SetContentFormat(message.TextPlain)
+	return cc.WriteMessage(m)
+}
+
+// writePayload sends a response, capping its size when the remote address looks like a reflection victim
+func writePayload(cc mux.Conn, token []byte, code codes.Code, format message.MediaType, payload []byte, obs int64) error {
+	return writeTypedPayload(cc, token, message.Unset, code, format, payload, obs)
+}
+
+// writeTypedPayload is writePayload with an explicit message type, message.Unset leaves the choice to the library
+func writeTypedPayload(cc mux.Conn, token []byte, typ message.Type, code codes.Code, format message.MediaType, payload []byte, obs int64) error {
+	victim := hostOf(cc.RemoteAddr())
+	limit := guard.responseLimit(victim)
+	capped := capPayload(payload, limit)
+	if len(capped) < len(payload) {
+		log.Printf("Capped response to suspicious source %s from %d to %d bytes", victim, len(payload), len(capped))
+	}
+
+	m := cc.AcquireMessage(cc.Context())
+	defer cc.ReleaseMessage(m)
+	if typ != message.Unset {
+		m.SetType(typ)
+	}
+	m.SetCode(code)
+	m.SetToken(token)
+	m.SetBody(bytes.NewReader(capped))
+	m.SetContentFormat(format)
 	if obs >= 0 {
 		m.SetObserve(uint32(obs))
 	}
+	guard.recordResponse(victim, len(capped))
 	return cc.WriteMessage(m)
 }
 
-func periodicTransmitter(cc mux.Conn, token []byte) {
-	subded := time.Now()
+func sendResponse(cc mux.Conn, token []byte, subded time.Time, obs int64) error {
+	payload := []byte(fmt.Sprintf("Been running for %v", time.Since(subded)))
+	return writePayload(cc, token, codes.Content, message.TextPlain, payload, obs)
+}
+
+// periodicTransmitter sends a notification every second for an observed resource
+func periodicTransmitter(cc mux.Conn, token []byte, send func(obs int64) error) {
+	victim := hostOf(cc.RemoteAddr())
 
 	for obs := int64(2); ; obs++ {
-		err := sendResponse(cc, token, subded, obs)
+		// Observations are an easy way to turn one spoofed packet into an endless stream
+		if guard.isSuspicious(victim) {
+			log.Printf("Stopping observation for suspicious source %s", victim)
+			return
+		}
+		err := send(obs)
 		if err != nil {
 			log.Printf("Error on transmitter, stopping: %v", err)
 			return
@@ -49,7 +131,75 @@ func periodicTransmitter(cc mux.Conn, token []byte) {
 	}
 }
 
+// handleRequest logs every request and answers it like a small sensor node would
+func handleRequest(w mux.ResponseWriter, r *mux.Message) {
+	path := getPath(r.Options())
+	log.Printf("Got message path=%v: %+v from %v", path, r, w.Conn().RemoteAddr())
+
+	victim := hostOf(w.Conn().RemoteAddr())
+	suspicious := guard.observeRequest(victim, requestSize(r), r.Code() == codes.GET, path == wellKnownCore)
+
+	if group := multicastDestination(r); group != nil {
+		handleMulticast(w, r, path, group)
+		return
+	}
+
+	if isProxyRequest(r) {
+		handleProxy(w, r, path)
+		return
+	}
+
+	if p, ok := parseLwm2mPath(path); ok {
+		handleLwm2m(w, r, p)
+		return
+	}
+
+	if isDevicePath(path) {
+		handleDevice(w, r, path)
+		return
+	}
+
+	if res, ok := coapResources[path]; ok {
+		handleResource(w, r, path, res)
+		return
+	}
+
+	obs, err := r.Options().Observe()
+	switch {
+	case r.Code() == codes.GET && path == wellKnownCore:
+		if _, ok := negotiateFormat(r.Options(), []message.MediaType{message.AppLinkFormat}); !ok {
+			writeCode(w.Conn(), r.Token(), codes.NotAcceptable)
+			return
+		}
+		queries, _ := r.Options().Queries()
+		links := filterLinks(discoveryLinks(), queries)
+		err := writePayload(w.Conn(), r.Token(), codes.Content, message.AppLinkFormat, []byte(strings.Join(links, ",")), -1)
+		if err != nil {
+			log.Printf("Error on discovery response: %v", err)
+		}
+	case r.Code() == codes.GET:
+		if _, ok := negotiateFormat(r.Options(), []message.MediaType{message.TextPlain}); !ok {
+			writeCode(w.Conn(), r.Token(), codes.NotAcceptable)
+			return
+		}
+		if err == nil && obs == 0 && !suspicious {
+			subded := time.Now()
+			token := append([]byte(nil), r.Token()...)
+			go periodicTransmitter(w.Conn(), token, func(obs int64) error {
+				return sendResponse(w.Conn(), token, subded, obs)
+			})
+			return
+		}
+		err := sendResponse(w.Conn(), r.Token(), time.Now(), -1)
+		if err != nil {
+			log.Printf("Error on transmitter: %v", err)
+		}
+	}
+}
+
 func main() {
+	flag.Parse()
+
 	// Create a logs directory if it doesn't exist
 	err := os.MkdirAll("/logs", 0777)
 	if err != nil {
@@ -69,20 +219,33 @@ func main() {
 	multiWriter := io.MultiWriter(os.Stdout, logFile)
 	log.SetOutput(multiWriter)
 
+	// Build the emulated LwM2M object tree
+	lwm2mObjects = newLwm2mModel()
+
+	// Forget about sources that have gone quiet
+	go guard.expire()
+
 	log.Print("CoAP server starting on port 5683")
 
-	log.Fatal(coap.ListenAndServe("udp", "0.0.0.0:5683",
-		mux.HandlerFunc(func(w mux.ResponseWriter, r *mux.Message) {
-			log.Printf("Got message path=%v: %+v from %v", getPath(r.Options()), r, w.Conn().RemoteAddr())
-			obs, err := r.Options().Observe()
-			switch {
-			case r.Code() == codes.GET && err == nil && obs == 0:
-				go periodicTransmitter(w.Conn(), r.Token())
-			case r.Code() == codes.GET:
-				err := sendResponse(w.Conn(), r.Token(), time.Now(), -1)
-				if err != nil {
-					log.Printf("Error on transmitter: %v", err)
-				}
-			}
-		})))
+	// A "udp" listener on the wildcard address is a dual-stack IPv6 socket which
+	// cannot join IPv4 groups, so multicast mode uses one listener per family
+	network := "udp"
+	if *enableMulticast {
+		network = "udp4"
+	}
+	l, err := coapNet.NewListenUDP(network, "0.0.0.0:5683")
+	if err != nil {
+		log.Fatalf("Error starting UDP listener: %v", err)
+	}
+	defer l.Close()
+
+	if *enableMulticast {
+		if err := joinGroups(l, multicastGroupsIPv4); err != nil {
+			log.Printf("IPv4 multicast disabled: %v", err)
+		}
+		go serveMulticastIPv6(mux.HandlerFunc(handleRequest))
+	}
+
+	s := udp.NewServer(options.WithMux(mux.HandlerFunc(handleRequest)))
+	log.Fatal(s.Serve(l))
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/mux"
+)
+
+// devicesPrefix is where the data generator publishes the readings of the decoy plant
+const devicesPrefix = "/devices/"
+
+// maxDevices bounds the store so nobody can fill our memory by PUTting random paths
+const maxDevices = 256
+
+// maxReadingSize bounds a single stored reading, the readings of the generator are a few hundred bytes
+const maxReadingSize = 1024
+
+// deviceReading is the last payload published to a device resource, served back as-is
+type deviceReading struct {
+	format  message.MediaType
+	payload []byte
+	updated time.Time
+}
+
+var (
+	devicesMu sync.Mutex
+	devices   = make(map[string]deviceReading)
+)
+
+// deviceLinks returns the link-format entries for the device resources published so far
+func deviceLinks() []string {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+
+	paths := make([]string, 0, len(devices))
+	for path := range devices {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	links := make([]string, 0, len(paths))
+	for _, path := range paths {
+		links = append(links, fmt.Sprintf(`<%s>;rt="ot-device";ct=%d;obs`, path, devices[path].format))
+	}
+	return links
+}
+
+// handleDevice stores readings published with PUT or POST and serves the last one on GET
+func handleDevice(w mux.ResponseWriter, r *mux.Message, path string) {
+	cc := w.Conn()
+
+	var err error
+	switch r.Code() {
+	case codes.PUT, codes.POST:
+		payload, rerr := r.ReadBody()
+		format, ferr := r.Options().ContentFormat()
+		if rerr != nil || ferr != nil || len(payload) == 0 {
+			err = writeCode(cc, r.Token(), codes.BadRequest)
+			break
+		}
+		if len(payload) > maxReadingSize {
+			logEvent("oversized_reading", hostOf(cc.RemoteAddr()), "path=%s size=%d", path, len(payload))
+			err = writeCode(cc, r.Token(), codes.RequestEntityTooLarge)
+			break
+		}
+
+		devicesMu.Lock()
+		_, exists := devices[path]
+		if !exists && len(devices) >= maxDevices {
+			devicesMu.Unlock()
+			err = writeCode(cc, r.Token(), codes.InternalServerError)
+			break
+		}
+		devices[path] = deviceReading{format: format, payload: payload, updated: time.Now()}
+		devicesMu.Unlock()
+
+		if exists {
+			err = writeCode(cc, r.Token(), codes.Changed)
+		} else {
+			err = writeCode(cc, r.Token(), codes.Created)
+		}
+	case codes.GET:
+		devicesMu.Lock()
+		reading, ok := devices[path]
+		devicesMu.Unlock()
+		if !ok {
+			err = writeCode(cc, r.Token(), codes.NotFound)
+			break
+		}
+		if _, ok := negotiateFormat(r.Options(), []message.MediaType{reading.format}); !ok {
+			err = writeCode(cc, r.Token(), codes.NotAcceptable)
+			break
+		}
+		err = writePayload(cc, r.Token(), codes.Content, reading.format, reading.payload, -1)
+	case codes.DELETE:
+		logEvent("resource_delete", hostOf(cc.RemoteAddr()), "path=%s", path)
+		err = writeCode(cc, r.Token(), codes.Forbidden)
+	default:
+		err = writeCode(cc, r.Token(), codes.MethodNotAllowed)
+	}
+	if err != nil {
+		log.Printf("Error on response for %s: %v", path, err)
+	}
+}
+
+// isDevicePath reports whether a path addresses one of the published device resources
+func isDevicePath(path string) bool {
+	return strings.HasPrefix(path, devicesPrefix) && len(path) > len(devicesPrefix)
+}
@@ -2,13 +2,17 @@ module coap-server
 
 go 1.23.0
 
-require github.com/plgd-dev/go-coap/v3 v3.3.6
+require (
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/plgd-dev/go-coap/v3 v3.3.6
+)
 
 require (
 	github.com/dsnet/golib/memfile v1.0.0 // indirect
 	github.com/pion/dtls/v3 v3.0.2 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/transport/v3 v3.0.7 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	go.uber.org/atomic v1.11.0 // indirect
 	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/exp v0.0.0-20240823005443-9b4947da3948 // indirect
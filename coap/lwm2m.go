@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/mux"
+)
+
+// lwm2mResource is a single resource of an object instance. Multi-instance
+// resources keep their values in a []interface{} indexed by resource instance.
+type lwm2mResource struct {
+	value    interface{}
+	initial  interface{}
+	read     func() interface{}
+	writable bool
+	execute  func(source, args string)
+}
+
+// lwm2mObject is an LwM2M object with its instances and their resources
+type lwm2mObject struct {
+	name      string
+	protected bool
+	instances map[uint16]map[uint16]*lwm2mResource
+}
+
+// lwm2mPath is a parsed /object[/instance[/resource]] path
+type lwm2mPath struct {
+	object   uint16
+	instance uint16
+	resource uint16
+	depth    int
+}
+
+var (
+	lwm2mMu          sync.Mutex
+	lwm2mObjects     map[uint16]*lwm2mObject
+	lwm2mRebootUntil time.Time
+)
+
+// Firmware update states and results (object 5, resources 3 and 5)
+const (
+	firmwareIdle        = 0
+	firmwareDownloading = 1
+	firmwareDownloaded  = 2
+	firmwareUpdating    = 3
+
+	firmwareResultInitial   = 0
+	firmwareResultIntegrity = 5
+)
+
+// maxLoggedPayload limits how much of a written value ends up in the log, firmware images can be large
+const maxLoggedPayload = 256
+
+func (p lwm2mPath) String() string {
+	switch p.depth {
+	case 1:
+		return fmt.Sprintf("/%d", p.object)
+	case 2:
+		return fmt.Sprintf("/%d/%d", p.object, p.instance)
+	}
+	return fmt.Sprintf("/%d/%d/%d", p.object, p.instance, p.resource)
+}
+
+// parseLwm2mPath reports whether the CoAP path addresses the LwM2M object tree
+func parseLwm2mPath(path string) (lwm2mPath, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) == 0 || len(parts) > 3 {
+		return lwm2mPath{}, false
+	}
+
+	var ids [3]uint16
+	for i, part := range parts {
+		id, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return lwm2mPath{}, false
+		}
+		ids[i] = uint16(id)
+	}
+	if _, ok := lwm2mObjects[ids[0]]; !ok {
+		return lwm2mPath{}, false
+	}
+	return lwm2mPath{object: ids[0], instance: ids[1], resource: ids[2], depth: len(parts)}, true
+}
+
+// lwm2mLinks returns the link-format entries for all emulated object instances
+func lwm2mLinks() string {
+	var links []string
+	for _, objID := range sortedKeys(lwm2mObjects) {
+		for _, instID := range sortedKeys(lwm2mObjects[objID].instances) {
+			links = append(links, fmt.Sprintf("</%d/%d>", objID, instID))
+		}
+	}
+	return strings.Join(links, ",")
+}
+
+// handleLwm2m serves GET, PUT, POST and DELETE requests on the LwM2M object tree
+func handleLwm2m(w mux.ResponseWriter, r *mux.Message, p lwm2mPath) {
+	cc := w.Conn()
+	source := hostOf(cc.RemoteAddr())
+
+	lwm2mMu.Lock()
+	rebooting := time.Now().Before(lwm2mRebootUntil)
+	lwm2mMu.Unlock()
+	if rebooting {
+		writeCode(cc, r.Token(), codes.ServiceUnavailable)
+		return
+	}
+
+	var err error
+	switch r.Code() {
+	case codes.GET:
+		format := lwm2mDefaultFormat(p)
+		if accept, aerr := r.Options().Accept(); aerr == nil {
+			format = accept
+		}
+		logEvent("lwm2m_read", source, "path=%s object=%q format=%q", p, lwm2mObjects[p.object].name, format)
+
+		obs, oerr := r.Options().Observe()
+		if oerr == nil && obs == 0 && !guard.isSuspicious(source) {
+			go lwm2mObserve(cc, append([]byte(nil), r.Token()...), p, format)
+			return
+		}
+		err = lwm2mRespond(cc, r.Token(), p, format, -1)
+	case codes.PUT:
+		payload, _ := r.ReadBody()
+		format, _ := r.Options().ContentFormat()
+		err = writeCode(cc, r.Token(), lwm2mWrite(source, p, format, payload))
+	case codes.POST:
+		payload, _ := r.ReadBody()
+		err = writeCode(cc, r.Token(), lwm2mExecute(source, p, string(payload)))
+	case codes.DELETE:
+		logEvent("lwm2m_delete", source, "path=%s", p)
+		err = writeCode(cc, r.Token(), codes.MethodNotAllowed)
+	}
+	if err != nil {
+		log.Printf("Error on LwM2M response: %v", err)
+	}
+}
+
+// lwm2mRespond encodes the addressed part of the object tree and sends it
+func lwm2mRespond(cc mux.Conn, token []byte, p lwm2mPath, format message.MediaType, obs int64) error {
+	payload, code := encodeLwm2m(p, format)
+	if code != codes.Content {
+		return writeCode(cc, token, code)
+	}
+	return writePayload(cc, token, codes.Content, format, payload, obs)
+}
+
+// lwm2mObserve sends notifications for an observed path until the client goes away
+func lwm2mObserve(cc mux.Conn, token []byte, p lwm2mPath, format message.MediaType) {
+	source := hostOf(cc.RemoteAddr())
+
+	for obs := int64(2); ; obs++ {
+		if guard.isSuspicious(source) {
+			log.Printf("Stopping LwM2M observation of %s for suspicious source %s", p, source)
+			return
+		}
+		if err := lwm2mRespond(cc, token, p, format, obs); err != nil {
+			log.Printf("Error on LwM2M observation of %s, stopping: %v", p, err)
+			return
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// lwm2mDefaultFormat picks the format a client would use when no Accept option is given
+func lwm2mDefaultFormat(p lwm2mPath) message.MediaType {
+	if p.depth < 3 {
+		return message.AppLwm2mTLV
+	}
+	return message.TextPlain
+}
+
+// encodeLwm2m serialises the addressed object, instance or resource in the requested format
+func encodeLwm2m(p lwm2mPath, format message.MediaType) ([]byte, codes.Code) {
+	lwm2mMu.Lock()
+	defer lwm2mMu.Unlock()
+
+	obj := lwm2mObjects[p.object]
+	if obj.protected {
+		// Real clients never let anyone read back their credentials
+		return nil, codes.Unauthorized
+	}
+
+	instIDs := sortedKeys(obj.instances)
+	if p.depth > 1 {
+		if _, ok := obj.instances[p.instance]; !ok {
+			return nil, codes.NotFound
+		}
+		instIDs = []uint16{p.instance}
+	}
+	if p.depth == 3 {
+		res, ok := obj.instances[p.instance][p.resource]
+		if !ok {
+			return nil, codes.NotFound
+		}
+		if res.execute != nil {
+			return nil, codes.MethodNotAllowed
+		}
+	}
+
+	switch format {
+	case message.TextPlain:
+		if p.depth < 3 {
+			return nil, codes.NotAcceptable
+		}
+		value := obj.instances[p.instance][p.resource].current()
+		if _, multi := value.([]interface{}); multi {
+			return nil, codes.NotAcceptable
+		}
+		return []byte(lwm2mText(value)), codes.Content
+	case message.AppLwm2mTLV:
+		var buf bytes.Buffer
+		for _, instID := range instIDs {
+			var inner bytes.Buffer
+			for _, resID := range lwm2mResourceIDs(obj.instances[instID], p) {
+				encodeResourceTLV(&inner, resID, obj.instances[instID][resID].current())
+			}
+			if p.depth == 1 {
+				encodeTLV(&buf, tlvObjectInstance, instID, inner.Bytes())
+			} else {
+				buf.Write(inner.Bytes())
+			}
+		}
+		return buf.Bytes(), codes.Content
+	case message.AppSenmlJSON, message.AppSenmlCbor:
+		var records []senmlRecord
+		for _, instID := range instIDs {
+			for _, resID := range lwm2mResourceIDs(obj.instances[instID], p) {
+				records = append(records, senmlResourceRecords(instID, resID, obj.instances[instID][resID].current())...)
+			}
+		}
+		if len(records) > 0 {
+			records[0].BaseName = fmt.Sprintf("/%d/", p.object)
+		}
+
+		var payload []byte
+		var err error
+		if format == message.AppSenmlJSON {
+			payload, err = encodeSenMLJSON(records)
+		} else {
+			payload, err = encodeSenMLCBOR(records)
+		}
+		if err != nil {
+			log.Printf("Error encoding SenML for %s: %v", p, err)
+			return nil, codes.InternalServerError
+		}
+		return payload, codes.Content
+	}
+	return nil, codes.NotAcceptable
+}
+
+// lwm2mResourceIDs returns the readable resources of an instance that fall under the path
+func lwm2mResourceIDs(inst map[uint16]*lwm2mResource, p lwm2mPath) []uint16 {
+	if p.depth == 3 {
+		return []uint16{p.resource}
+	}
+	var ids []uint16
+	for _, id := range sortedKeys(inst) {
+		if inst[id].execute == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func encodeResourceTLV(buf *bytes.Buffer, id uint16, value interface{}) {
+	values, multi := value.([]interface{})
+	if !multi {
+		encodeTLV(buf, tlvResourceValue, id, tlvValue(value))
+		return
+	}
+	var inner bytes.Buffer
+	for i, v := range values {
+		encodeTLV(&inner, tlvResourceInstance, uint16(i), tlvValue(v))
+	}
+	encodeTLV(buf, tlvMultipleResource, id, inner.Bytes())
+}
+
+func senmlResourceRecords(instID, resID uint16, value interface{}) []senmlRecord {
+	values, multi := value.([]interface{})
+	if !multi {
+		record := senmlRecord{Name: fmt.Sprintf("%d/%d", instID, resID)}
+		record.setValue(value)
+		return []senmlRecord{record}
+	}
+	var records []senmlRecord
+	for i, v := range values {
+		record := senmlRecord{Name: fmt.Sprintf("%d/%d/%d", instID, resID, i)}
+		record.setValue(v)
+		records = append(records, record)
+	}
+	return records
+}
+
+func lwm2mText(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case time.Time:
+		return strconv.FormatInt(v.Unix(), 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// lwm2mWrite handles a PUT on a resource and logs whatever the client tried to store
+func lwm2mWrite(source string, p lwm2mPath, format message.MediaType, payload []byte) codes.Code {
+	logEvent("lwm2m_write", source, "path=%s format=%q size=%d payload=%x", p, format, len(payload), capPayload(payload, maxLoggedPayload))
+
+	lwm2mMu.Lock()
+	defer lwm2mMu.Unlock()
+
+	if p.depth != 3 {
+		return codes.MethodNotAllowed
+	}
+	inst, ok := lwm2mObjects[p.object].instances[p.instance]
+	if !ok {
+		return codes.NotFound
+	}
+	res, ok := inst[p.resource]
+	if !ok {
+		return codes.NotFound
+	}
+	if !res.writable {
+		return codes.MethodNotAllowed
+	}
+
+	value, err := decodeLwm2mValue(format, payload, res.value)
+	if err != nil {
+		log.Printf("Cannot decode LwM2M write to %s from %s: %v", p, source, err)
+		return codes.BadRequest
+	}
+	res.value = value
+
+	// Firmware delivery is the most interesting thing an attacker can do to a device
+	if p.object == 5 {
+		lwm2mFirmwareWrite(source, p.resource, value)
+	}
+	return codes.Changed
+}
+
+// lwm2mExecute handles a POST on an executable resource
+func lwm2mExecute(source string, p lwm2mPath, args string) codes.Code {
+	logEvent("lwm2m_execute", source, "path=%s args=%q", p, args)
+
+	lwm2mMu.Lock()
+	defer lwm2mMu.Unlock()
+
+	if p.depth != 3 {
+		return codes.MethodNotAllowed
+	}
+	res, ok := lwm2mObjects[p.object].instances[p.instance][p.resource]
+	if !ok {
+		return codes.NotFound
+	}
+	if res.execute == nil {
+		return codes.MethodNotAllowed
+	}
+	res.execute(source, args)
+	return codes.Changed
+}
+
+// decodeLwm2mValue converts a written payload into the Go type of the current value
+func decodeLwm2mValue(format message.MediaType, payload []byte, current interface{}) (interface{}, error) {
+	var text string
+	switch format {
+	case message.TextPlain:
+		text = string(payload)
+	case message.AppOctets:
+		if _, ok := current.([]byte); ok {
+			return payload, nil
+		}
+		text = string(payload)
+	case message.AppLwm2mTLV:
+		value, err := decodeTLVValue(payload)
+		if err != nil {
+			return nil, err
+		}
+		return tlvToValue(value, current), nil
+	case message.AppSenmlJSON, message.AppSenmlCbor:
+		var records []senmlRecord
+		var err error
+		if format == message.AppSenmlJSON {
+			err = json.Unmarshal(payload, &records)
+		} else {
+			err = cbor.Unmarshal(payload, &records)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, errors.New("empty SenML pack")
+		}
+		return senmlToValue(records[0], current), nil
+	default:
+		return nil, fmt.Errorf("unsupported content format %v", format)
+	}
+
+	switch current.(type) {
+	case int64:
+		return strconv.ParseInt(text, 10, 64)
+	case float64:
+		return strconv.ParseFloat(text, 64)
+	case bool:
+		return text == "1" || text == "true", nil
+	case []byte:
+		return []byte(text), nil
+	}
+	return text, nil
+}
+
+// decodeTLVValue returns the value bytes of the first TLV entry in the payload
+func decodeTLVValue(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, errors.New("TLV too short")
+	}
+	typ := data[0]
+	pos := 2
+	if typ&0x20 != 0 {
+		pos++
+	}
+
+	length := int(typ & 0x07)
+	lengthBytes := int(typ>>3) & 0x03
+	if len(data) < pos+lengthBytes {
+		return nil, errors.New("TLV length truncated")
+	}
+	if lengthBytes > 0 {
+		length = 0
+		for i := 0; i < lengthBytes; i++ {
+			length = length<<8 | int(data[pos+i])
+		}
+		pos += lengthBytes
+	}
+	if len(data) < pos+length {
+		return nil, errors.New("TLV value truncated")
+	}
+	return data[pos : pos+length], nil
+}
+
+func tlvToValue(value []byte, current interface{}) interface{} {
+	switch current.(type) {
+	case int64:
+		var v int64
+		for i, b := range value {
+			if i == 0 {
+				v = int64(int8(b))
+				continue
+			}
+			v = v<<8 | int64(b)
+		}
+		return v
+	case float64:
+		switch len(value) {
+		case 4:
+			return float64(math.Float32frombits(uint32(value[0])<<24 | uint32(value[1])<<16 | uint32(value[2])<<8 | uint32(value[3])))
+		case 8:
+			var bits uint64
+			for _, b := range value {
+				bits = bits<<8 | uint64(b)
+			}
+			return math.Float64frombits(bits)
+		}
+		return current
+	case bool:
+		return len(value) > 0 && value[0] != 0
+	case []byte:
+		return value
+	}
+	return string(value)
+}
+
+func senmlToValue(record senmlRecord, current interface{}) interface{} {
+	switch current.(type) {
+	case int64:
+		if record.Value != nil {
+			return int64(*record.Value)
+		}
+	case float64:
+		if record.Value != nil {
+			return *record.Value
+		}
+	case bool:
+		if record.BoolValue != nil {
+			return *record.BoolValue
+		}
+	case []byte:
+		return []byte(record.DataValue)
+	case string:
+		if record.StringValue != nil {
+			return *record.StringValue
+		}
+	}
+	return current
+}
+
+// lwm2mFirmwareWrite walks the firmware object through a download whenever a package or URI is pushed.
+// Must be called with lwm2mMu held.
+func lwm2mFirmwareWrite(source string, resource uint16, value interface{}) {
+	fw := lwm2mObjects[5].instances[0]
+	switch resource {
+	case 0:
+		pkg, _ := value.([]byte)
+		logEvent("lwm2m_firmware_package", source, "size=%d sha256=%x", len(pkg), sha256.Sum256(pkg))
+		fw[3].value = int64(firmwareDownloaded)
+	case 1:
+		logEvent("lwm2m_firmware_uri", source, "uri=%q", value)
+		fw[3].value = int64(firmwareDownloading)
+		time.AfterFunc(3*time.Second, func() {
+			lwm2mMu.Lock()
+			defer lwm2mMu.Unlock()
+			fw[3].value = int64(firmwareDownloaded)
+		})
+	}
+}
+
+// current returns the live value of a resource
+func (r *lwm2mResource) current() interface{} {
+	if r.read != nil {
+		return r.read()
+	}
+	return r.value
+}
+
+// sensor returns a read function wandering around base, also tracking min and max measured values
+func sensor(base, spread float64, minRes, maxRes *lwm2mResource) func() interface{} {
+	value := base
+	return func() interface{} {
+		value += (rand.Float64() - 0.5) * spread / 5
+		value = math.Max(base-spread, math.Min(base+spread, value))
+		rounded := math.Round(value*100) / 100
+		if minRes != nil && rounded < minRes.value.(float64) {
+			minRes.value = rounded
+		}
+		if maxRes != nil && rounded > maxRes.value.(float64) {
+			maxRes.value = rounded
+		}
+		return rounded
+	}
+}
+
+func static(value interface{}) *lwm2mResource {
+	return &lwm2mResource{value: value, initial: value}
+}
+
+func writable(value interface{}) *lwm2mResource {
+	return &lwm2mResource{value: value, initial: value, writable: true}
+}
+
+func executable(fn func(source, args string)) *lwm2mResource {
+	return &lwm2mResource{execute: fn}
+}
+
+// ipsoSensor builds an IPSO sensor instance (3303, 3304, 3323, ...) with a live sensor value
+func ipsoSensor(base, spread float64, units string, rangeMin, rangeMax float64) map[uint16]*lwm2mResource {
+	minMeasured := static(base)
+	maxMeasured := static(base)
+	return map[uint16]*lwm2mResource{
+		5700: {read: sensor(base, spread, minMeasured, maxMeasured)},
+		5701: static(units),
+		5601: minMeasured,
+		5602: maxMeasured,
+		5603: static(rangeMin),
+		5604: static(rangeMax),
+		5605: executable(func(source, args string) {
+			minMeasured.value = base
+			maxMeasured.value = base
+		}),
+	}
+}
+
+// newLwm2mModel builds the emulated object tree of a cellular sensor gateway
+func newLwm2mModel() map[uint16]*lwm2mObject {
+	serial := fmt.Sprintf("QB96%08d", rand.Intn(100000000))
+
+	device := map[uint16]*lwm2mResource{
+		0:  static("Quectel"),
+		1:  static("BG96-IOT"),
+		2:  static(serial),
+		3:  static("BG96MAR02A07M1G"),
+		6:  static([]interface{}{int64(1), int64(5)}),
+		7:  static([]interface{}{int64(3800), int64(5000)}),
+		8:  static([]interface{}{int64(125), int64(900)}),
+		9:  static(int64(95)),
+		10: static(int64(15)),
+		11: static([]interface{}{int64(0)}),
+		13: {read: func() interface{} { return time.Now() }},
+		14: writable("+01:00"),
+		15: writable("Europe/Amsterdam"),
+		16: static("UQ"),
+		17: static("sensor gateway"),
+		18: static("1.3"),
+		19: static("2.4.1"),
+		20: static(int64(0)),
+		21: static(int64(64)),
+	}
+	device[4] = executable(func(source, args string) {
+		logEvent("lwm2m_reboot", source, "device=%s", serial)
+		lwm2mRebootUntil = time.Now().Add(10 * time.Second)
+	})
+	device[5] = executable(func(source, args string) {
+		logEvent("lwm2m_factory_reset", source, "device=%s", serial)
+		lwm2mFactoryReset()
+		lwm2mRebootUntil = time.Now().Add(30 * time.Second)
+	})
+	device[12] = executable(func(source, args string) {
+		device[11].value = []interface{}{int64(0)}
+	})
+
+	firmware := map[uint16]*lwm2mResource{
+		0: writable([]byte{}),
+		1: writable(""),
+		3: static(int64(firmwareIdle)),
+		5: static(int64(firmwareResultInitial)),
+		6: static("BG96MAR02A07M1G"),
+		7: static("02.07"),
+		9: static(int64(2)),
+	}
+	firmware[2] = executable(func(source, args string) {
+		logEvent("lwm2m_firmware_update", source, "state=%v uri=%q", firmware[3].value, firmware[1].value)
+		if firmware[3].value != int64(firmwareDownloaded) {
+			return
+		}
+		firmware[3].value = int64(firmwareUpdating)
+		// Pretend to flash the image and fail its signature check, like a locked-down device would
+		time.AfterFunc(5*time.Second, func() {
+			lwm2mMu.Lock()
+			defer lwm2mMu.Unlock()
+			firmware[3].value = int64(firmwareIdle)
+			firmware[5].value = int64(firmwareResultIntegrity)
+		})
+	})
+
+	server := map[uint16]*lwm2mResource{
+		0: static(int64(123)),
+		1: writable(int64(300)),
+		2: writable(int64(1)),
+		3: writable(int64(60)),
+		6: writable(true),
+		7: writable("U"),
+	}
+	server[8] = executable(func(source, args string) {})
+
+	return map[uint16]*lwm2mObject{
+		0: {name: "Security", protected: true, instances: map[uint16]map[uint16]*lwm2mResource{
+			0: {
+				0:  static("coaps://lwm2m.plant.local:5684"),
+				1:  static(false),
+				2:  static(int64(0)),
+				3:  static([]byte(serial)),
+				5:  static([]byte{0x3a, 0x91, 0x5c, 0x07, 0xe2, 0x44, 0x18, 0xbd}),
+				10: static(int64(123)),
+			},
+		}},
+		1: {name: "Server", instances: map[uint16]map[uint16]*lwm2mResource{0: server}},
+		3: {name: "Device", instances: map[uint16]map[uint16]*lwm2mResource{0: device}},
+		4: {name: "Connectivity Monitoring", instances: map[uint16]map[uint16]*lwm2mResource{
+			0: {
+				0:  static(int64(6)),
+				1:  static([]interface{}{int64(6), int64(7)}),
+				2:  {read: func() interface{} { return int64(-80 - rand.Intn(15)) }},
+				3:  static(int64(64)),
+				4:  static([]interface{}{"10.10.0.40"}),
+				5:  static([]interface{}{"10.10.0.1"}),
+				7:  static([]interface{}{"iot.plant"}),
+				8:  static(int64(21053)),
+				9:  static(int64(8)),
+				10: static(int64(204)),
+			},
+		}},
+		5:    {name: "Firmware Update", instances: map[uint16]map[uint16]*lwm2mResource{0: firmware}},
+		3303: {name: "Temperature", instances: map[uint16]map[uint16]*lwm2mResource{0: ipsoSensor(21.5, 3, "Cel", -40, 125)}},
+		3304: {name: "Humidity", instances: map[uint16]map[uint16]*lwm2mResource{0: ipsoSensor(45, 10, "%RH", 0, 100)}},
+		3323: {name: "Pressure", instances: map[uint16]map[uint16]*lwm2mResource{0: ipsoSensor(101.3, 1.5, "kPa", 0, 200)}},
+		3306: {name: "Actuation", instances: map[uint16]map[uint16]*lwm2mResource{
+			0: {
+				5850: writable(true),
+				5851: writable(int64(100)),
+				5750: writable("Pump P-101"),
+			},
+		}},
+	}
+}
+
+// lwm2mFactoryReset restores every writable resource to its initial value. Must be called with lwm2mMu held.
+func lwm2mFactoryReset() {
+	for _, obj := range lwm2mObjects {
+		for _, inst := range obj.instances {
+			for _, res := range inst {
+				if res.writable {
+					res.value = res.initial
+				}
+			}
+		}
+	}
+}
+
+func sortedKeys[V any](m map[uint16]V) []uint16 {
+	keys := make([]uint16, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/mux"
+	coapNet "github.com/plgd-dev/go-coap/v3/net"
+	"github.com/plgd-dev/go-coap/v3/options"
+	"github.com/plgd-dev/go-coap/v3/udp"
+)
+
+// All-CoAP-Nodes multicast groups (RFC 7252 section 12.8)
+var (
+	multicastGroupsIPv4 = []net.IP{net.ParseIP("224.0.1.187")}
+	multicastGroupsIPv6 = []net.IP{
+		net.ParseIP("ff02::fd"), // link-local
+		net.ParseIP("ff05::fd"), // site-local
+	}
+)
+
+// joinGroups joins the given multicast groups on every interface that supports multicast
+func joinGroups(l *coapNet.UDPConn, groups []net.IP) error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("cannot list interfaces: %w", err)
+	}
+
+	joined := 0
+	for _, group := range groups {
+		for i := range ifaces {
+			iface := ifaces[i]
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+				continue
+			}
+			if err := l.JoinGroup(&iface, &net.UDPAddr{IP: group}); err != nil {
+				log.Printf("Cannot join multicast group %s on %s: %v", group, iface.Name, err)
+				continue
+			}
+			log.Printf("Joined multicast group %s on %s", group, iface.Name)
+			joined++
+		}
+	}
+	if joined == 0 {
+		return fmt.Errorf("no interface joined groups %v", groups)
+	}
+	return nil
+}
+
+// serveMulticastIPv6 runs a second listener for the IPv6 All-CoAP-Nodes groups.
+// Containers frequently have no IPv6 at all, so failures are only logged.
+func serveMulticastIPv6(handler mux.Handler) {
+	l, err := coapNet.NewListenUDP("udp6", "[::]:5683")
+	if err != nil {
+		log.Printf("IPv6 multicast disabled: %v", err)
+		return
+	}
+	defer l.Close()
+
+	if err := joinGroups(l, multicastGroupsIPv6); err != nil {
+		log.Printf("IPv6 multicast disabled: %v", err)
+		return
+	}
+
+	s := udp.NewServer(options.WithMux(handler))
+	if err := s.Serve(l); err != nil {
+		log.Printf("IPv6 multicast listener stopped: %v", err)
+	}
+}
+
+// multicastDestination returns the group a request was sent to, or nil for unicast requests
+func multicastDestination(r *mux.Message) net.IP {
+	cm := r.ControlMessage()
+	if cm == nil || cm.Dst == nil || !cm.Dst.IsMulticast() {
+		return nil
+	}
+	return cm.Dst
+}
+
+// handleMulticast answers multicast requests the way RFC 7252 section 8 asks
+// a server to: only discovery is answered, never with an error, and only after
+// a random delay within the leisure period so that all nodes on the link do
+// not reply at once. Every request is logged, local discovery inside an OT
+// network is a strong hint of someone moving laterally.
+func handleMulticast(w mux.ResponseWriter, r *mux.Message, path string, group net.IP) {
+	cc := w.Conn()
+	source := hostOf(cc.RemoteAddr())
+	queries, _ := r.Options().Queries()
+	logEvent("multicast_discovery", source, "group=%s code=%v path=%s query=%q", group, r.Code(), path, strings.Join(queries, "&"))
+
+	if r.Code() != codes.GET || path != wellKnownCore {
+		return
+	}
+	if _, ok := negotiateFormat(r.Options(), []message.MediaType{message.AppLinkFormat}); !ok {
+		return
+	}
+	links := filterLinks(discoveryLinks(), queries)
+	if len(links) == 0 {
+		return
+	}
+
+	token := append([]byte(nil), r.Token()...)
+	var delay time.Duration
+	if *multicastLeisure > 0 {
+		delay = time.Duration(rand.Int63n(int64(*multicastLeisure)))
+	}
+	time.AfterFunc(delay, func() {
+		// Multicast requests are always non-confirmable and so is the answer
+		err := writeTypedPayload(cc, token, message.NonConfirmable, codes.Content, message.AppLinkFormat, []byte(strings.Join(links, ",")), -1)
+		if err != nil {
+			log.Printf("Error on multicast discovery response to %s: %v", source, err)
+		}
+	})
+}
+
+// filterLinks applies RFC 6690 query filtering (href or link attribute, with a trailing * as prefix match)
+func filterLinks(links []string, queries []string) []string {
+	var matched []string
+	for _, link := range links {
+		if linkMatches(link, queries) {
+			matched = append(matched, link)
+		}
+	}
+	return matched
+}
+
+func linkMatches(link string, queries []string) bool {
+	for _, query := range queries {
+		name, value, _ := strings.Cut(query, "=")
+		prefix := strings.HasSuffix(value, "*")
+		value = strings.TrimSuffix(value, "*")
+
+		var candidates []string
+		parts := strings.Split(link, ";")
+		if name == "href" {
+			candidates = []string{strings.Trim(parts[0], "<>")}
+		} else {
+			for _, attr := range parts[1:] {
+				if attrName, attrValue, ok := strings.Cut(attr, "="); ok && attrName == name {
+					candidates = append(candidates, strings.Fields(strings.Trim(attrValue, `"`))...)
+				}
+			}
+		}
+
+		found := false
+		for _, candidate := range candidates {
+			if candidate == value || (prefix && strings.HasPrefix(candidate, value)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
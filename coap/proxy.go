@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/mux"
+)
+
+// isProxyRequest reports whether a request asks us to act as a forward proxy
+func isProxyRequest(r *mux.Message) bool {
+	return r.Options().HasOption(message.ProxyURI) || r.Options().HasOption(message.ProxyScheme)
+}
+
+// proxyTarget rebuilds the URI a client wants us to forward to, either from
+// Proxy-Uri or from Proxy-Scheme combined with the Uri-* options (RFC 7252 section 5.10.2)
+func proxyTarget(r *mux.Message, path string) string {
+	if uri, err := r.Options().GetString(message.ProxyURI); err == nil {
+		return uri
+	}
+
+	scheme, _ := r.Options().GetString(message.ProxyScheme)
+	host, err := r.Options().GetString(message.URIHost)
+	if err != nil {
+		host = "localhost"
+	}
+	if port, err := r.Options().GetUint32(message.URIPort); err == nil {
+		host = fmt.Sprintf("%s:%d", host, port)
+	}
+	target := fmt.Sprintf("%s://%s%s", scheme, host, path)
+	if queries, err := r.Options().Queries(); err == nil && len(queries) > 0 {
+		target += "?" + strings.Join(queries, "&")
+	}
+	return target
+}
+
+// handleProxy pretends to be a forward proxy without ever contacting the target.
+// Whether an upstream "answers" is derived from its host, so repeated probes of
+// the same target get consistent results and the proxy looks like a real one
+// that can reach part of the network.
+func handleProxy(w mux.ResponseWriter, r *mux.Message, path string) {
+	cc := w.Conn()
+	source := hostOf(cc.RemoteAddr())
+	target := proxyTarget(r, path)
+	logEvent("proxy_abuse", source, "code=%v target=%q proxy_enabled=%t", r.Code(), target, *enableProxy)
+
+	if !*enableProxy {
+		if err := writeCode(cc, r.Token(), codes.ProxyingNotSupported); err != nil {
+			log.Printf("Error on proxy response: %v", err)
+		}
+		return
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		if err := writeCode(cc, r.Token(), codes.BadOption); err != nil {
+			log.Printf("Error on proxy response: %v", err)
+		}
+		return
+	}
+
+	token := append([]byte(nil), r.Token()...)
+	code := r.Code()
+	// Answer after what looks like an upstream round trip
+	time.AfterFunc(time.Duration(200+rand.Intn(1800))*time.Millisecond, func() {
+		var err error
+		switch {
+		case u.Scheme != "coap" && u.Scheme != "coaps":
+			err = writeCode(cc, token, codes.BadGateway)
+		case !upstreamReachable(u.Hostname()):
+			err = writeCode(cc, token, codes.GatewayTimeout)
+		case code == codes.GET && u.Path == wellKnownCore:
+			err = writePayload(cc, token, codes.Content, message.AppLinkFormat, []byte(`</sensors>;ct=40,</config>;rt="config",</fw>;rt="firmware"`), -1)
+		case code == codes.GET:
+			err = writeCode(cc, token, codes.NotFound)
+		default:
+			err = writeCode(cc, token, codes.MethodNotAllowed)
+		}
+		if err != nil {
+			log.Printf("Error on proxy response to %s: %v", source, err)
+		}
+	})
+}
+
+// upstreamReachable decides once per host whether the fake proxy can reach it
+func upstreamReachable(host string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return h.Sum32()%3 == 0
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/mux"
+)
+
+// reading is a single named value served by one of the plain CoAP resources
+type reading struct {
+	name  string
+	unit  string
+	value interface{}
+}
+
+// coapResource is a plain (non LwM2M) resource listed in /.well-known/core.
+// Values are taken from the LwM2M object tree so both views of the device agree.
+type coapResource struct {
+	readings func() []reading
+	write    func(source string, values map[string]interface{}) codes.Code
+}
+
+// supportedFormats lists the content formats the sensor resources can be encoded in
+var supportedFormats = []message.MediaType{
+	message.TextPlain,
+	message.AppJSON,
+	message.AppCBOR,
+	message.AppSenmlJSON,
+	message.AppSenmlCbor,
+}
+
+// senmlBaseName identifies this device in SenML packs, like the MAC based URNs real nodes use
+const senmlBaseName = "urn:dev:mac:0024e8fffe51a07c:"
+
+var bootTime = time.Now()
+
+var coapResources = map[string]coapResource{
+	"/sensors/temp": {readings: func() []reading {
+		return []reading{{name: "temperature", unit: "Cel", value: lwm2mValue(3303, 0, 5700)}}
+	}},
+	"/sensors/humidity": {readings: func() []reading {
+		return []reading{{name: "humidity", unit: "%RH", value: lwm2mValue(3304, 0, 5700)}}
+	}},
+	"/sensors/pressure": {readings: func() []reading {
+		return []reading{{name: "pressure", unit: "kPa", value: lwm2mValue(3323, 0, 5700)}}
+	}},
+	"/actuators/valve": {
+		readings: func() []reading {
+			return []reading{
+				{name: "open", value: lwm2mValue(3306, 0, 5850)},
+				{name: "position", unit: "%", value: lwm2mValue(3306, 0, 5851)},
+			}
+		},
+		write: writeValve,
+	},
+	"/status": {readings: func() []reading {
+		return []reading{
+			{name: "uptime", unit: "s", value: int64(time.Since(bootTime).Seconds())},
+			{name: "battery", unit: "%", value: lwm2mValue(3, 0, 9)},
+			{name: "state", value: "running"},
+		}
+	}},
+	"/firmware": {readings: func() []reading {
+		return []reading{
+			{name: "version", value: lwm2mValue(3, 0, 3)},
+			{name: "update_state", value: lwm2mValue(5, 0, 3)},
+		}
+	}},
+}
+
+// lwm2mValue reads the current value of a resource in the LwM2M object tree
+func lwm2mValue(object, instance, resource uint16) interface{} {
+	lwm2mMu.Lock()
+	defer lwm2mMu.Unlock()
+
+	return lwm2mObjects[object].instances[instance][resource].current()
+}
+
+// negotiateFormat returns the format to answer in, or false when the Accept option asks for something we cannot produce
+func negotiateFormat(opts message.Options, supported []message.MediaType) (message.MediaType, bool) {
+	accept, err := opts.Accept()
+	if err != nil {
+		return supported[0], true
+	}
+	for _, format := range supported {
+		if format == accept {
+			return format, true
+		}
+	}
+	return accept, false
+}
+
+// encodeReadings serialises readings in the requested content format
+func encodeReadings(format message.MediaType, readings []reading) ([]byte, error) {
+	switch format {
+	case message.TextPlain:
+		if len(readings) == 1 {
+			return []byte(strings.TrimSpace(lwm2mText(readings[0].value) + " " + readings[0].unit)), nil
+		}
+		var lines []string
+		for _, r := range readings {
+			lines = append(lines, strings.TrimSpace(fmt.Sprintf("%s=%s %s", r.name, lwm2mText(r.value), r.unit)))
+		}
+		return []byte(strings.Join(lines, "\n")), nil
+	case message.AppJSON, message.AppCBOR:
+		values := make(map[string]interface{}, len(readings))
+		for _, r := range readings {
+			values[r.name] = r.value
+		}
+		if format == message.AppJSON {
+			return json.Marshal(values)
+		}
+		return cbor.Marshal(values)
+	case message.AppSenmlJSON, message.AppSenmlCbor:
+		records := make([]senmlRecord, 0, len(readings))
+		for _, r := range readings {
+			record := senmlRecord{Name: r.name, Unit: r.unit}
+			record.setValue(r.value)
+			records = append(records, record)
+		}
+		if len(records) > 0 {
+			records[0].BaseName = senmlBaseName
+			records[0].BaseTime = float64(time.Now().Unix())
+		}
+		if format == message.AppSenmlJSON {
+			return encodeSenMLJSON(records)
+		}
+		return encodeSenMLCBOR(records)
+	}
+	return nil, fmt.Errorf("unsupported content format %v", format)
+}
+
+// decodeValues parses a written payload into named values, whatever format the client used
+func decodeValues(format message.MediaType, payload []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	switch format {
+	case message.TextPlain:
+		text := strings.TrimSpace(string(payload))
+		if name, value, ok := strings.Cut(text, "="); ok {
+			values[name] = value
+		} else {
+			values[""] = text
+		}
+	case message.AppJSON:
+		if err := json.Unmarshal(payload, &values); err != nil {
+			return nil, err
+		}
+	case message.AppCBOR:
+		if err := cbor.Unmarshal(payload, &values); err != nil {
+			return nil, err
+		}
+	case message.AppSenmlJSON, message.AppSenmlCbor:
+		var records []senmlRecord
+		var err error
+		if format == message.AppSenmlJSON {
+			err = json.Unmarshal(payload, &records)
+		} else {
+			err = cbor.Unmarshal(payload, &records)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			switch {
+			case r.Value != nil:
+				values[r.Name] = *r.Value
+			case r.BoolValue != nil:
+				values[r.Name] = *r.BoolValue
+			case r.StringValue != nil:
+				values[r.Name] = *r.StringValue
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content format %v", format)
+	}
+	return values, nil
+}
+
+// handleResource serves GET and PUT on the plain sensor and actuator resources
+func handleResource(w mux.ResponseWriter, r *mux.Message, path string, res coapResource) {
+	cc := w.Conn()
+	source := hostOf(cc.RemoteAddr())
+
+	var err error
+	switch r.Code() {
+	case codes.GET:
+		format, ok := negotiateFormat(r.Options(), supportedFormats)
+		if !ok {
+			logEvent("not_acceptable", source, "path=%s accept=%q", path, format)
+			err = writeCode(cc, r.Token(), codes.NotAcceptable)
+			break
+		}
+
+		obs, oerr := r.Options().Observe()
+		if oerr == nil && obs == 0 && !guard.isSuspicious(source) {
+			// The request message goes back to the pool once we return
+			token := append([]byte(nil), r.Token()...)
+			go periodicTransmitter(cc, token, func(obs int64) error {
+				return sendReadings(cc, token, format, res, obs)
+			})
+			return
+		}
+		err = sendReadings(cc, r.Token(), format, res, -1)
+	case codes.PUT, codes.POST:
+		payload, _ := r.ReadBody()
+		format, _ := r.Options().ContentFormat()
+		logEvent("resource_write", source, "path=%s format=%q size=%d payload=%x", path, format, len(payload), capPayload(payload, maxLoggedPayload))
+		if res.write == nil {
+			err = writeCode(cc, r.Token(), codes.MethodNotAllowed)
+			break
+		}
+		values, derr := decodeValues(format, payload)
+		if derr != nil {
+			log.Printf("Cannot decode write to %s from %s: %v", path, source, derr)
+			err = writeCode(cc, r.Token(), codes.UnsupportedMediaType)
+			break
+		}
+		err = writeCode(cc, r.Token(), res.write(source, values))
+	default:
+		err = writeCode(cc, r.Token(), codes.MethodNotAllowed)
+	}
+	if err != nil {
+		log.Printf("Error on response for %s: %v", path, err)
+	}
+}
+
+func sendReadings(cc mux.Conn, token []byte, format message.MediaType, res coapResource, obs int64) error {
+	payload, err := encodeReadings(format, res.readings())
+	if err != nil {
+		return err
+	}
+	return writePayload(cc, token, codes.Content, format, payload, obs)
+}
+
+// writeValve opens or closes the valve through the LwM2M actuation object
+func writeValve(source string, values map[string]interface{}) codes.Code {
+	lwm2mMu.Lock()
+	defer lwm2mMu.Unlock()
+
+	actuation := lwm2mObjects[3306].instances[0]
+	for name, value := range values {
+		switch name {
+		case "", "open":
+			open, ok := toBool(value)
+			if !ok {
+				return codes.BadRequest
+			}
+			actuation[5850].value = open
+		case "position":
+			position, ok := toFloat(value)
+			if !ok || position < 0 || position > 100 {
+				return codes.BadRequest
+			}
+			actuation[5851].value = int64(position)
+		default:
+			return codes.BadRequest
+		}
+	}
+	logEvent("actuator_change", source, "actuator=valve open=%v position=%v", actuation[5850].value, actuation[5851].value)
+	return codes.Changed
+}
+
+func toBool(v interface{}) (bool, bool) {
+	switch val := v.(type) {
+	case bool:
+		return val, true
+	case string:
+		b, err := strconv.ParseBool(val)
+		return b, err == nil
+	}
+	f, ok := toFloat(v)
+	return f != 0, ok
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case int64:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	case string:
+		f, err := strconv.ParseFloat(val, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// senmlRecord is a single SenML (RFC 8428) record. The CBOR labels are the
+// integer keys from the RFC so the same struct serves senml+json and senml+cbor.
+type senmlRecord struct {
+	BaseName    string    `json:"bn,omitempty" cbor:"-2,keyasint,omitempty"`
+	BaseTime    float64   `json:"bt,omitempty" cbor:"-3,keyasint,omitempty"`
+	Name        string    `json:"n,omitempty" cbor:"0,keyasint,omitempty"`
+	Unit        string    `json:"u,omitempty" cbor:"1,keyasint,omitempty"`
+	Value       *float64  `json:"v,omitempty" cbor:"2,keyasint,omitempty"`
+	StringValue *string   `json:"vs,omitempty" cbor:"3,keyasint,omitempty"`
+	BoolValue   *bool     `json:"vb,omitempty" cbor:"4,keyasint,omitempty"`
+	Time        float64   `json:"t,omitempty" cbor:"6,keyasint,omitempty"`
+	DataValue   senmlData `json:"vd,omitempty" cbor:"8,keyasint,omitempty"`
+}
+
+// senmlData is an opaque value, base64url encoded in JSON and a byte string in CBOR
+type senmlData []byte
+
+func (d senmlData) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(d))
+}
+
+func (d *senmlData) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*d = decoded
+	return nil
+}
+
+// setValue fills the value field of a record that matches the Go type of v
+func (r *senmlRecord) setValue(v interface{}) {
+	switch val := v.(type) {
+	case string:
+		r.StringValue = &val
+	case []byte:
+		r.DataValue = val
+	case bool:
+		r.BoolValue = &val
+	case int:
+		f := float64(val)
+		r.Value = &f
+	case int64:
+		f := float64(val)
+		r.Value = &f
+	case float64:
+		r.Value = &val
+	case time.Time:
+		f := float64(val.Unix())
+		r.Value = &f
+	}
+}
+
+func encodeSenMLJSON(records []senmlRecord) ([]byte, error) {
+	return json.Marshal(records)
+}
+
+func encodeSenMLCBOR(records []senmlRecord) ([]byte, error) {
+	return cbor.Marshal(records)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestSenMLRecordSetValue(t *testing.T) {
+	num := func(f float64) *float64 { return &f }
+	str := func(s string) *string { return &s }
+	boolean := func(b bool) *bool { return &b }
+	tests := []struct {
+		name  string
+		value interface{}
+		want  senmlRecord
+	}{
+		{"string", "fw", senmlRecord{StringValue: str("fw")}},
+		{"opaque", []byte{1, 2}, senmlRecord{DataValue: senmlData{1, 2}}},
+		{"bool", true, senmlRecord{BoolValue: boolean(true)}},
+		{"int", 3, senmlRecord{Value: num(3)}},
+		{"int64", int64(-4), senmlRecord{Value: num(-4)}},
+		{"float", 2.5, senmlRecord{Value: num(2.5)}},
+		{"time", time.Unix(1700000000, 0), senmlRecord{Value: num(1700000000)}},
+		{"unsupported", uint8(1), senmlRecord{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got senmlRecord
+			got.setValue(tt.value)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("setValue(%v) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeSenMLJSON(t *testing.T) {
+	v := 21.5
+	vs := "on"
+	tests := []struct {
+		name    string
+		records []senmlRecord
+		want    string
+	}{
+		{"base name and value", []senmlRecord{{BaseName: "urn:dev:x:", Name: "temp", Unit: "Cel", Value: &v}}, `[{"bn":"urn:dev:x:","n":"temp","u":"Cel","v":21.5}]`},
+		{"string value", []senmlRecord{{Name: "0/1", StringValue: &vs}}, `[{"n":"0/1","vs":"on"}]`},
+		{"opaque as unpadded base64url", []senmlRecord{{Name: "5/0", DataValue: senmlData{0xFB, 0xFF}}}, `[{"n":"5/0","vd":"-_8"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeSenMLJSON(tt.records)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("encodeSenMLJSON() = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSenMLDataUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    senmlData
+		wantErr bool
+	}{
+		{"unpadded", `"-_8"`, senmlData{0xFB, 0xFF}, false},
+		{"padded", `"-_8="`, senmlData{0xFB, 0xFF}, false},
+		{"empty", `""`, senmlData{}, false},
+		{"standard alphabet", `"+/8"`, nil, true},
+		{"not a string", `12`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got senmlData
+			err := json.Unmarshal([]byte(tt.data), &got)
+			if (err != nil) != tt.wantErr || (!tt.wantErr && !bytes.Equal(got, tt.want)) {
+				t.Errorf("Unmarshal(%s) = % x, %v, want % x", tt.data, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeSenMLCBOR(t *testing.T) {
+	v := 1.5
+	b := true
+	records := []senmlRecord{
+		{BaseName: "urn:dev:x:", Name: "temp", Value: &v},
+		{Name: "on", BoolValue: &b},
+		{Name: "blob", DataValue: senmlData{1, 2, 3}},
+	}
+	data, err := encodeSenMLCBOR(records)
+	if err != nil {
+		t.Fatalf("encodeSenMLCBOR() = %v", err)
+	}
+
+	// RFC 8428 labels are integers, the names never go on the wire
+	var raw []map[int]interface{}
+	if err := cbor.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("records are not CBOR maps with integer keys: %v", err)
+	}
+	if raw[0][-2] != "urn:dev:x:" || raw[0][0] != "temp" || raw[0][2] != 1.5 || raw[1][4] != true {
+		t.Errorf("encodeSenMLCBOR() labels = %v", raw)
+	}
+	if got, ok := raw[2][8].([]byte); !ok || !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("opaque value = %#v, want a byte string", raw[2][8])
+	}
+
+	var decoded []senmlRecord
+	if err := cbor.Unmarshal(data, &decoded); err != nil || !reflect.DeepEqual(decoded, records) {
+		t.Errorf("round trip = %+v, %v, want %+v", decoded, err, records)
+	}
+}
+
+func TestSenMLToValue(t *testing.T) {
+	v := 7.9
+	vs := "name"
+	vb := true
+	record := senmlRecord{Value: &v, StringValue: &vs, BoolValue: &vb, DataValue: senmlData{9}}
+	tests := []struct {
+		name    string
+		record  senmlRecord
+		current interface{}
+		want    interface{}
+	}{
+		{"integer truncates", record, int64(0), int64(7)},
+		{"float", record, 0.0, 7.9},
+		{"bool", record, false, true},
+		{"string", record, "", "name"},
+		{"missing value keeps current", senmlRecord{}, int64(3), int64(3)},
+		{"missing string keeps current", senmlRecord{Value: &v}, "old", "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := senmlToValue(tt.record, tt.current); got != tt.want {
+				t.Errorf("senmlToValue(%T) = %v, want %v", tt.current, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// OMA LwM2M TLV identifier types (bits 7-6 of the type byte)
+const (
+	tlvObjectInstance   byte = 0x00
+	tlvResourceInstance byte = 0x40
+	tlvMultipleResource byte = 0x80
+	tlvResourceValue    byte = 0xC0
+)
+
+// encodeTLV writes a single TLV entry with the given identifier type, id and value
+func encodeTLV(buf *bytes.Buffer, kind byte, id uint16, value []byte) {
+	typ := kind
+	if id > 0xFF {
+		typ |= 0x20
+	}
+
+	length := len(value)
+	switch {
+	case length < 8:
+		typ |= byte(length)
+	case length <= 0xFF:
+		typ |= 0x08
+	case length <= 0xFFFF:
+		typ |= 0x10
+	default:
+		typ |= 0x18
+	}
+	buf.WriteByte(typ)
+
+	if id > 0xFF {
+		buf.WriteByte(byte(id >> 8))
+	}
+	buf.WriteByte(byte(id))
+
+	switch {
+	case length < 8:
+	case length <= 0xFF:
+		buf.WriteByte(byte(length))
+	case length <= 0xFFFF:
+		buf.WriteByte(byte(length >> 8))
+		buf.WriteByte(byte(length))
+	default:
+		buf.WriteByte(byte(length >> 16))
+		buf.WriteByte(byte(length >> 8))
+		buf.WriteByte(byte(length))
+	}
+	buf.Write(value)
+}
+
+// tlvValue converts a resource value into its TLV binary representation
+func tlvValue(v interface{}) []byte {
+	switch val := v.(type) {
+	case string:
+		return []byte(val)
+	case []byte:
+		return val
+	case bool:
+		if val {
+			return []byte{1}
+		}
+		return []byte{0}
+	case int:
+		return tlvInteger(int64(val))
+	case int64:
+		return tlvInteger(val)
+	case time.Time:
+		return tlvInteger(val.Unix())
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(val))
+		return b
+	}
+	return nil
+}
+
+// tlvInteger uses the smallest of the 1, 2, 4 or 8 byte signed encodings that fits the value
+func tlvInteger(v int64) []byte {
+	switch {
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return []byte{byte(v)}
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(v))
+		return b
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		return b
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
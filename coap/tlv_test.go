@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeTLV(t *testing.T) {
+	tests := []struct {
+		name   string
+		kind   byte
+		id     uint16
+		length int
+		header []byte // type, identifier and length bytes
+	}{
+		{"empty", tlvResourceValue, 1, 0, []byte{0xC0, 0x01}},
+		{"length in type byte", tlvResourceValue, 1, 7, []byte{0xC7, 0x01}},
+		{"8-bit length", tlvResourceValue, 1, 8, []byte{0xC8, 0x01, 0x08}},
+		{"8-bit length max", tlvResourceValue, 1, 0xFF, []byte{0xC8, 0x01, 0xFF}},
+		{"16-bit length", tlvResourceValue, 1, 0x100, []byte{0xD0, 0x01, 0x01, 0x00}},
+		{"16-bit length max", tlvResourceValue, 1, 0xFFFF, []byte{0xD0, 0x01, 0xFF, 0xFF}},
+		{"24-bit length", tlvResourceValue, 1, 0x10000, []byte{0xD8, 0x01, 0x01, 0x00, 0x00}},
+		{"16-bit identifier", tlvResourceValue, 0x1234, 1, []byte{0xE1, 0x12, 0x34}},
+		{"16-bit identifier and length", tlvObjectInstance, 0x100, 0x100, []byte{0x30, 0x01, 0x00, 0x01, 0x00}},
+		{"object instance", tlvObjectInstance, 0, 2, []byte{0x02, 0x00}},
+		{"resource instance", tlvResourceInstance, 3, 1, []byte{0x41, 0x03}},
+		{"multiple resource", tlvMultipleResource, 7, 3, []byte{0x83, 0x07}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := bytes.Repeat([]byte{0xAB}, tt.length)
+			var buf bytes.Buffer
+			encodeTLV(&buf, tt.kind, tt.id, value)
+			want := append(append([]byte{}, tt.header...), value...)
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("encodeTLV() header = % x, want % x", buf.Bytes()[:min(buf.Len(), len(tt.header))], tt.header)
+			}
+
+			got, err := decodeTLVValue(buf.Bytes())
+			if err != nil || !bytes.Equal(got, value) {
+				t.Errorf("decodeTLVValue() = %d bytes, %v, want %d bytes", len(got), err, len(value))
+			}
+		})
+	}
+}
+
+func TestDecodeTLVValueTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"no identifier", []byte{0xC1}, "too short"},
+		{"missing length byte", []byte{0xC8, 0x01}, "length truncated"},
+		{"missing second length byte", []byte{0xD0, 0x01, 0x01}, "length truncated"},
+		{"short value", []byte{0xC3, 0x01, 0xAA}, "value truncated"},
+		{"short value after length", []byte{0xC8, 0x01, 0x09, 0xAA}, "value truncated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeTLVValue(tt.data); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("decodeTLVValue(% x) = %v, want %q", tt.data, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLVValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []byte
+	}{
+		{"string", "abc", []byte("abc")},
+		{"opaque", []byte{1, 2}, []byte{1, 2}},
+		{"true", true, []byte{1}},
+		{"false", false, []byte{0}},
+		{"int8", int64(-1), []byte{0xFF}},
+		{"int8 max", int64(math.MaxInt8), []byte{0x7F}},
+		{"int16", int64(math.MaxInt8 + 1), []byte{0x00, 0x80}},
+		{"int16 min", int64(math.MinInt16), []byte{0x80, 0x00}},
+		{"int32", int(math.MaxInt16 + 1), []byte{0x00, 0x00, 0x80, 0x00}},
+		{"int64", int64(math.MaxInt32 + 1), []byte{0, 0, 0, 0, 0x80, 0, 0, 0}},
+		{"time", time.Unix(1700000000, 0), []byte{0x65, 0x53, 0xF1, 0x00}},
+		{"float", 1.5, []byte{0x3F, 0xF8, 0, 0, 0, 0, 0, 0}},
+		{"unsupported", uint8(1), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tlvValue(tt.value); !bytes.Equal(got, tt.want) {
+				t.Errorf("tlvValue(%v) = % x, want % x", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLVToValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   []byte
+		current interface{}
+		want    interface{}
+	}{
+		{"int8", []byte{0xFE}, int64(0), int64(-2)},
+		{"int16", []byte{0xFF, 0x00}, int64(0), int64(-256)},
+		{"int32", []byte{0x00, 0x01, 0x00, 0x00}, int64(0), int64(65536)},
+		{"float32", []byte{0x3F, 0xC0, 0x00, 0x00}, 0.0, 1.5},
+		{"float64", []byte{0x3F, 0xF8, 0, 0, 0, 0, 0, 0}, 0.0, 1.5},
+		{"float of odd length keeps current", []byte{0x01}, 2.5, 2.5},
+		{"bool", []byte{1}, false, true},
+		{"empty bool", []byte{}, true, false},
+		{"string", []byte("x"), "", "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tlvToValue(tt.value, tt.current); got != tt.want {
+				t.Errorf("tlvToValue(% x, %T) = %v, want %v", tt.value, tt.current, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeResourceTLV(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []byte
+	}{
+		{"single", int64(5), []byte{0xC1, 0x02, 0x05}},
+		{"multiple", []interface{}{int64(1), "ab"}, []byte{0x87, 0x02, 0x41, 0x00, 0x01, 0x42, 0x01, 'a', 'b'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			encodeResourceTLV(&buf, 2, tt.value)
+			if !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Errorf("encodeResourceTLV() = % x, want % x", buf.Bytes(), tt.want)
+			}
+		})
+	}
+}
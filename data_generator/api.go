@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serviceStats tracks the outcome of generating data for one service
+type serviceStats struct {
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+	sent        int
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = make(map[string]*serviceStats)
+)
+
+// recordServiceResult updates the status of a service after a round of generation
+func recordServiceResult(service string, sent int, err error) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	st, ok := stats[service]
+	if !ok {
+		st = &serviceStats{}
+		stats[service] = st
+	}
+	st.sent += sent
+	if err != nil {
+		st.lastError = err.Error()
+		st.lastErrorAt = time.Now()
+	} else {
+		st.lastSuccess = time.Now()
+	}
+}
+
+// serviceView is the JSON representation of a service in the API
+type serviceView struct {
+	Name         string     `json:"name"`
+	Running      bool       `json:"running"`
+	IntervalMs   int64      `json:"interval_ms"`
+	Health       string     `json:"health"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastErrorAt  *time.Time `json:"last_error_at,omitempty"`
+	MessagesSent int        `json:"messages_sent"`
+}
+
+func viewService(service string) serviceView {
+	interval, running := scheduler.Interval(service)
+	v := serviceView{Name: service, Running: running, IntervalMs: interval.Milliseconds()}
+	if entry, ok := publishersByID[service]; ok {
+		v.Health = entry.health()
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if st, ok := stats[service]; ok {
+		if !st.lastSuccess.IsZero() {
+			at := st.lastSuccess
+			v.LastSuccess = &at
+		}
+		if !st.lastErrorAt.IsZero() {
+			at := st.lastErrorAt
+			v.LastError = st.lastError
+			v.LastErrorAt = &at
+		}
+		v.MessagesSent = st.sent
+	}
+	return v
+}
+
+// registerAPI adds the JSON control API next to the HTML page
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/services", func(w http.ResponseWriter, r *http.Request) {
+		views := make([]serviceView, 0, len(publishers))
+		for _, p := range publishers {
+			views = append(views, viewService(p.name))
+		}
+		writeJSON(w, http.StatusOK, views)
+	})
+	mux.HandleFunc("GET /api/services/{name}", withService(func(w http.ResponseWriter, r *http.Request, service string) {
+		writeJSON(w, http.StatusOK, viewService(service))
+	}))
+	mux.HandleFunc("POST /api/services/{name}/start", withService(startServiceHandler))
+	mux.HandleFunc("POST /api/services/{name}/stop", withService(func(w http.ResponseWriter, r *http.Request, service string) {
+		scheduler.Stop(service)
+		writeJSON(w, http.StatusOK, viewService(service))
+	}))
+	mux.HandleFunc("PUT /api/services/{name}/rate", withService(func(w http.ResponseWriter, r *http.Request, service string) {
+		interval, err := readInterval(r, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		scheduler.SetInterval(service, interval)
+		writeJSON(w, http.StatusOK, viewService(service))
+	}))
+
+	mux.HandleFunc("PUT /api/devices/{id}/rate", func(w http.ResponseWriter, r *http.Request) {
+		d, ok := current().fleet.byID[r.PathValue("id")]
+		if !ok {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		interval, err := readInterval(r, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.SetInterval(interval)
+		writeJSON(w, http.StatusOK, d.view())
+	})
+
+	mux.HandleFunc("POST /api/devices/{id}/ack", func(w http.ResponseWriter, r *http.Request) {
+		d, ok := current().fleet.byID[r.PathValue("id")]
+		if !ok {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		// Without a code every alarm of the device is acknowledged
+		var body struct {
+			Code int `json:"code"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		d.Ack(body.Code, "API")
+		writeJSON(w, http.StatusOK, d.view())
+	})
+
+	mux.HandleFunc("GET /api/events", eventsHandler)
+
+	mux.HandleFunc("GET /api/scenarios", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, current().scenarios.List())
+	})
+	mux.HandleFunc("POST /api/scenarios", func(w http.ResponseWriter, r *http.Request) {
+		var c ScenarioConfig
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		// Triggered scenarios start right away unless they say otherwise
+		s := current()
+		scenario, err := s.scenarios.Add(c, s.fleet, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, scenario.view())
+	})
+}
+
+// withService resolves the {name} of a service route, answering 404 for unknown services
+func withService(handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		service := r.PathValue("name")
+		if _, ok := publishersByID[service]; !ok {
+			http.Error(w, "Service not found", http.StatusNotFound)
+			return
+		}
+		handler(w, r, service)
+	}
+}
+
+func startServiceHandler(w http.ResponseWriter, r *http.Request, service string) {
+	interval, err := readInterval(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if interval == 0 {
+		interval, _ = scheduler.Interval(service)
+	}
+	scheduler.Start(service, interval)
+	writeJSON(w, http.StatusOK, viewService(service))
+}
+
+// readInterval reads {"interval_ms": n} from a request body. An empty body is
+// only accepted when the interval is optional, and then returns zero.
+func readInterval(r *http.Request, required bool) (time.Duration, error) {
+	var body struct {
+		IntervalMs int `json:"interval_ms"`
+	}
+	if r.ContentLength == 0 && !required {
+		return 0, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("invalid body: %v", err)
+	}
+	if body.IntervalMs <= 0 {
+		if required {
+			return 0, fmt.Errorf("interval_ms must be positive")
+		}
+		return 0, nil
+	}
+	return time.Duration(body.IntervalMs) * time.Millisecond, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
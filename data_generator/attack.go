@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/plgd-dev/go-coap/v3/options"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	udpClient "github.com/plgd-dev/go-coap/v3/udp/client"
+	"github.com/plgd-dev/go-coap/v3/udp/coder"
+)
+
+var attackFile = flag.String("attack", "", "Play the attack script in this file against the honeypots and write the events they should log to -output")
+
+// AttackIdentity is a fake attacker the script acts as
+type AttackIdentity struct {
+	Name     string `json:"name"`
+	SourceIP string `json:"source_ip"` // local address the traffic is sent from, any address when empty
+	ClientID string `json:"client_id"` // MQTT client id, the name when empty
+	Username string `json:"username"`  // MQTT credentials
+	Password string `json:"password"`
+}
+
+// AttackStep is one scripted action against a honeypot
+type AttackStep struct {
+	Name       string   `json:"name"`
+	Kind       string   `json:"kind"` // modbus_scan, modbus_write, coap_discovery, coap_flood, mqtt_subscribe or mqtt_publish
+	Identity   string   `json:"identity"`
+	Delay      string   `json:"delay"`       // wait before the step, such as "2s"
+	Units      []int    `json:"units"`       // modbus_scan: unit ids to sweep, 1 when empty
+	Function   int      `json:"function"`    // modbus_scan: read function, 3 (holding registers) by default
+	From       int      `json:"from"`        // modbus_scan: first address
+	To         int      `json:"to"`          // modbus_scan: last address, from when not set
+	Quantity   int      `json:"quantity"`    // modbus_scan: registers or coils per read, 10 by default
+	Unit       int      `json:"unit"`        // modbus_write: unit id, 1 by default
+	Address    int      `json:"address"`     // modbus_write: first register or coil
+	Coil       bool     `json:"coil"`        // modbus_write: write coils instead of registers
+	Values     []uint16 `json:"values"`      // modbus_write: one value writes a single point, more write multiple
+	Path       string   `json:"path"`        // coap_flood: resource, /.well-known/core by default
+	Count      int      `json:"count"`       // coap_flood: requests to send
+	IntervalMs int      `json:"interval_ms"` // coap_flood: pause between requests
+	Topic      string   `json:"topic"`       // mqtt_subscribe and mqtt_publish
+	Payload    string   `json:"payload"`     // mqtt_publish
+	Retain     bool     `json:"retain"`      // mqtt_publish
+	Duration   string   `json:"duration"`    // mqtt_subscribe: how long to listen, 5s by default
+}
+
+// AttackScript is the content of an attack file
+type AttackScript struct {
+	Identities []AttackIdentity `json:"identities"`
+	Steps      []AttackStep     `json:"steps"`
+}
+
+// ExpectedEvent is what a honeypot should log for a step of an attack script
+type ExpectedEvent struct {
+	Time     time.Time `json:"time"`
+	Step     string    `json:"step"`
+	Identity string    `json:"identity"`
+	Source   string    `json:"source,omitempty"` // the address the honeypot sees the traffic come from
+	Honeypot string    `json:"honeypot"`         // modbus, coap or mqtt
+	Target   string    `json:"target"`           // address of the honeypot
+	Event    string    `json:"event"`            // such as modbus_read or mqtt_publish
+	Log      string    `json:"log"`              // text the log line of the honeypot contains
+	Count    int       `json:"count"`            // how often the line should be logged
+	Detail   string    `json:"detail,omitempty"`
+	Error    string    `json:"error,omitempty"` // why the step failed, the honeypot may not log anything then
+}
+
+// Thresholds of the CoAP honeypot for flagging a source as an amplification
+// attempt, as in coap/amplification.go
+const (
+	coapWindow       = 10 * time.Second
+	coapMaxRequests  = 20
+	coapMaxDiscovery = 3
+	coapMaxRatio     = 8.0
+	coapMinRatioReqs = 10
+	coapIdleExpiry   = 5 * time.Minute
+)
+
+// attackTimeout bounds every connection and request of an attack
+const attackTimeout = 2 * time.Second
+
+// loadAttackScript reads and validates an attack file
+func loadAttackScript(path string) (*AttackScript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read attack file: %v", err)
+	}
+	var script AttackScript
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, fmt.Errorf("could not parse attack file: %v", err)
+	}
+
+	identities := make(map[string]bool)
+	for _, id := range script.Identities {
+		if id.Name == "" {
+			return nil, fmt.Errorf("attack identity without name")
+		}
+		if id.SourceIP != "" && net.ParseIP(id.SourceIP) == nil {
+			return nil, fmt.Errorf("attack identity %s has invalid source_ip %q", id.Name, id.SourceIP)
+		}
+		identities[id.Name] = true
+	}
+	for i := range script.Steps {
+		step := &script.Steps[i]
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("%s-%d", step.Kind, i+1)
+		}
+		if !identities[step.Identity] {
+			return nil, fmt.Errorf("attack step %s uses unknown identity %q", step.Name, step.Identity)
+		}
+		if step.Delay != "" {
+			if _, err := time.ParseDuration(step.Delay); err != nil {
+				return nil, fmt.Errorf("attack step %s has invalid delay %q", step.Name, step.Delay)
+			}
+		}
+		switch step.Kind {
+		case "modbus_scan":
+			if step.Function != 0 && (step.Function < 1 || step.Function > 4) {
+				return nil, fmt.Errorf("attack step %s has function %d, scans read with 1 to 4", step.Name, step.Function)
+			}
+		case "modbus_write":
+			if len(step.Values) == 0 {
+				return nil, fmt.Errorf("attack step %s has no values to write", step.Name)
+			}
+		case "coap_discovery", "coap_flood":
+		case "mqtt_subscribe", "mqtt_publish":
+			if step.Topic == "" {
+				return nil, fmt.Errorf("attack step %s needs a topic", step.Name)
+			}
+			if step.Duration != "" {
+				if _, err := time.ParseDuration(step.Duration); err != nil {
+					return nil, fmt.Errorf("attack step %s has invalid duration %q", step.Name, step.Duration)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("attack step %s has unknown kind %q", step.Name, step.Kind)
+		}
+	}
+	return &script, nil
+}
+
+// attackRun plays a script and writes the expected events
+type attackRun struct {
+	identities map[string]AttackIdentity
+	out        *bufio.Writer
+	enc        *json.Encoder
+	coap       map[string]*coapSource // by the source IP the CoAP honeypot sees
+}
+
+// coapSource mirrors the counters the CoAP honeypot keeps for one source IP,
+// so the requests of every step from that source add up like they do there.
+// The honeypot expires idle sources once a minute, the model exactly after
+// coapIdleExpiry, so a script pausing close to five minutes may not match.
+type coapSource struct {
+	windowStart  time.Time
+	lastSeen     time.Time
+	requests     int
+	amplified    int // answers larger than their request
+	discovery    int
+	bytesIn      int
+	bytesOut     int
+	suspicious   bool
+	reason       string
+	lastReported time.Time
+}
+
+// observe counts a GET the way the honeypot does and reports whether the
+// honeypot logs an amplification attempt for it
+func (s *coapSource) observe(now time.Time, size int, discovery bool) bool {
+	if now.Sub(s.lastSeen) > coapIdleExpiry {
+		*s = coapSource{}
+	}
+	if now.Sub(s.windowStart) > coapWindow {
+		// A flagged source stays flagged into the next window
+		*s = coapSource{windowStart: now, suspicious: s.suspicious, reason: s.reason, lastReported: s.lastReported}
+	}
+	s.lastSeen = now
+	s.requests++
+	s.bytesIn += size
+	if discovery {
+		s.discovery++
+	}
+
+	var reasons []string
+	if s.amplified > coapMaxRequests {
+		reasons = append(reasons, "request_rate")
+	}
+	if s.discovery > coapMaxDiscovery {
+		reasons = append(reasons, "repeated_discovery")
+	}
+	if s.requests >= coapMinRatioReqs && s.bytesIn > 0 && float64(s.bytesOut)/float64(s.bytesIn) > coapMaxRatio {
+		reasons = append(reasons, "response_ratio")
+	}
+	if len(reasons) > 0 {
+		s.suspicious = true
+		s.reason = strings.Join(reasons, ",")
+	}
+	if s.suspicious && now.Sub(s.lastReported) > coapWindow {
+		s.lastReported = now
+		return true
+	}
+	return false
+}
+
+// answer counts the answer to a GET like the honeypot does, toward the rate
+// when it is larger than the request
+func (s *coapSource) answer(request, size int) {
+	s.bytesOut += size
+	if size > request {
+		s.amplified++
+	}
+}
+
+// runAttack plays the attack script in path against the honeypots of the config.
+// Steps run one after another, a failing step is recorded and the script goes on.
+func runAttack(path string) error {
+	script, err := loadAttackScript(path)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *dryRunOutput != "-" {
+		f, err := os.Create(*dryRunOutput)
+		if err != nil {
+			return fmt.Errorf("could not create attack output: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	r := &attackRun{identities: make(map[string]AttackIdentity), out: bufio.NewWriter(out), coap: make(map[string]*coapSource)}
+	r.enc = json.NewEncoder(r.out)
+	for _, id := range script.Identities {
+		if id.ClientID == "" {
+			id.ClientID = id.Name
+		}
+		r.identities[id.Name] = id
+	}
+
+	for _, step := range script.Steps {
+		if step.Delay != "" {
+			delay, _ := time.ParseDuration(step.Delay)
+			time.Sleep(delay)
+		}
+		id := r.identities[step.Identity]
+		log.Printf("Attack step %s (%s) as %s", step.Name, step.Kind, id.Name)
+		switch step.Kind {
+		case "modbus_scan":
+			r.modbusScan(step, id)
+		case "modbus_write":
+			r.modbusWrite(step, id)
+		case "coap_discovery":
+			step.Path, step.Count = "/.well-known/core", 1
+			r.coapFlood(step, id)
+		case "coap_flood":
+			r.coapFlood(step, id)
+		case "mqtt_subscribe":
+			r.mqttSubscribe(step, id)
+		case "mqtt_publish":
+			r.mqttPublish(step, id)
+		}
+	}
+	if err := r.out.Flush(); err != nil {
+		return fmt.Errorf("could not write attack output: %v", err)
+	}
+	return nil
+}
+
+// expect writes an expected event, err marks the step as failed
+func (r *attackRun) expect(e ExpectedEvent, err error) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Count == 0 {
+		e.Count = 1
+	}
+	if err != nil {
+		e.Error = err.Error()
+		log.Printf("Attack step %s: %v", e.Step, err)
+	}
+	r.enc.Encode(e)
+}
+
+// sourceDialer returns a dialer that sends from the source address of an identity
+func sourceDialer(id AttackIdentity, network string) *net.Dialer {
+	d := &net.Dialer{Timeout: attackTimeout}
+	if ip := net.ParseIP(id.SourceIP); ip != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return d
+}
+
+// hostOf returns the IP of an address without its port
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// modbusRaw is a bare Modbus TCP client. Unlike the publisher it can send from
+// any source address and does not care whether answers make sense.
+type modbusRaw struct {
+	conn        net.Conn
+	transaction uint16
+}
+
+func dialModbus(id AttackIdentity) (*modbusRaw, error) {
+	config := current().config
+	address := net.JoinHostPort(config.ModBus.Address, strconv.Itoa(config.ModBus.Port))
+	conn, err := sourceDialer(id, "tcp").Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Modbus server on %s: %v", address, err)
+	}
+	return &modbusRaw{conn: conn}, nil
+}
+
+// request sends one request PDU to a unit and waits for an answer
+func (m *modbusRaw) request(unit int, pdu []byte) error {
+	m.transaction++
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:2], m.transaction)
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(pdu)+1))
+	frame[6] = byte(unit)
+	frame = append(frame, pdu...)
+
+	m.conn.SetDeadline(time.Now().Add(attackTimeout))
+	if _, err := m.conn.Write(frame); err != nil {
+		return err
+	}
+	answer := make([]byte, 260)
+	_, err := m.conn.Read(answer)
+	return err
+}
+
+// modbusPDU builds a request of a function with an address and a second word, the quantity or the value
+func modbusPDU(function int, address, word uint16, data ...byte) []byte {
+	pdu := []byte{byte(function), 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:3], address)
+	binary.BigEndian.PutUint16(pdu[3:5], word)
+	if len(data) > 0 {
+		pdu = append(pdu, byte(len(data)))
+		pdu = append(pdu, data...)
+	}
+	return pdu
+}
+
+// modbusLog is the start of the line the Modbus honeypot logs for a request from source (ip:port), up to the points it names
+func modbusLog(source string, unit, function int, address, word uint16) string {
+	prefix := fmt.Sprintf("Modbus request from %s: unit=%d function=%d", source, unit, function)
+	switch function {
+	case 1, 15:
+		return fmt.Sprintf("%s coils=%d+%d", prefix, address, word)
+	case 5:
+		return fmt.Sprintf("%s coil=%d value=%#04x", prefix, address, word)
+	case 3, 4, 16:
+		return fmt.Sprintf("%s registers=%d+%d", prefix, address, word)
+	case 6:
+		return fmt.Sprintf("%s register=%d value=%d", prefix, address, word)
+	}
+	return prefix
+}
+
+// modbusScan sweeps units and addresses with reads, like a scanner mapping a PLC
+func (r *attackRun) modbusScan(step AttackStep, id AttackIdentity) {
+	config := current().config
+	units, function, quantity, to := step.Units, step.Function, step.Quantity, step.To
+	if len(units) == 0 {
+		units = []int{1}
+	}
+	if function == 0 {
+		function = 3
+	}
+	if quantity <= 0 {
+		quantity = 10
+	}
+	if to < step.From {
+		to = step.From
+	}
+	event := ExpectedEvent{Step: step.Name, Identity: id.Name, Honeypot: "modbus", Target: net.JoinHostPort(config.ModBus.Address, strconv.Itoa(config.ModBus.Port)), Event: "modbus_read"}
+
+	m, err := dialModbus(id)
+	if err != nil {
+		r.expect(event, err)
+		return
+	}
+	defer m.conn.Close()
+	event.Source = hostOf(m.conn.LocalAddr())
+	for _, unit := range units {
+		for address := step.From; address <= to; address += quantity {
+			e := event
+			e.Time = time.Now()
+			e.Log = modbusLog(m.conn.LocalAddr().String(), unit, function, uint16(address), uint16(quantity))
+			err := m.request(unit, modbusPDU(function, uint16(address), uint16(quantity)))
+			r.expect(e, err)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// modbusWrite writes registers or coils, a single value with a single write
+func (r *attackRun) modbusWrite(step AttackStep, id AttackIdentity) {
+	config := current().config
+	unit := step.Unit
+	if unit == 0 {
+		unit = 1
+	}
+	address := uint16(step.Address)
+	var function int
+	var pdu []byte
+	switch {
+	case step.Coil && len(step.Values) == 1:
+		value := uint16(0)
+		if step.Values[0] != 0 {
+			value = 0xFF00
+		}
+		function, pdu = 5, modbusPDU(5, address, value)
+	case step.Coil:
+		bits := make([]byte, (len(step.Values)+7)/8)
+		for i, v := range step.Values {
+			if v != 0 {
+				bits[i/8] |= 1 << (i % 8)
+			}
+		}
+		function, pdu = 15, modbusPDU(15, address, uint16(len(step.Values)), bits...)
+	case len(step.Values) == 1:
+		function, pdu = 6, modbusPDU(6, address, step.Values[0])
+	default:
+		words := make([]byte, 2*len(step.Values))
+		for i, v := range step.Values {
+			binary.BigEndian.PutUint16(words[2*i:], v)
+		}
+		function, pdu = 16, modbusPDU(16, address, uint16(len(step.Values)), words...)
+	}
+
+	event := ExpectedEvent{
+		Step:     step.Name,
+		Identity: id.Name,
+		Honeypot: "modbus",
+		Target:   net.JoinHostPort(config.ModBus.Address, strconv.Itoa(config.ModBus.Port)),
+		Event:    "modbus_write",
+	}
+	m, err := dialModbus(id)
+	if err != nil {
+		r.expect(event, err)
+		return
+	}
+	defer m.conn.Close()
+	event.Source = hostOf(m.conn.LocalAddr())
+	event.Log = modbusLog(m.conn.LocalAddr().String(), unit, function, address, binary.BigEndian.Uint16(pdu[3:5]))
+	event.Time = time.Now()
+	r.expect(event, m.request(unit, pdu))
+}
+
+// coapFlood sends count GET requests to a resource. Requests and answers are
+// counted per source like the honeypot counts them, also across steps, so the
+// amplification attempts it logs for request rate, repeated discovery and the
+// response ratio are expected where it logs them.
+func (r *attackRun) coapFlood(step AttackStep, id AttackIdentity) {
+	config := current().config
+	path, count := step.Path, step.Count
+	if path == "" {
+		path = "/.well-known/core"
+	}
+	if count <= 0 {
+		count = 1
+	}
+	target := net.JoinHostPort(config.CoAP.Address, strconv.Itoa(config.CoAP.Port))
+	event := ExpectedEvent{Step: step.Name, Identity: id.Name, Honeypot: "coap", Target: target, Event: "coap_request", Time: time.Now()}
+	if path == "/.well-known/core" {
+		event.Event = "coap_discovery"
+	}
+	event.Log = fmt.Sprintf("Got message path=%s", path)
+
+	conn, err := udp.Dial(target, options.WithDialer(sourceDialer(id, "udp")))
+	if err != nil {
+		r.expect(event, fmt.Errorf("failed to connect to CoAP server on %s: %v", target, err))
+		return
+	}
+	defer conn.Close()
+	event.Source = hostOf(conn.LocalAddr())
+	source, ok := r.coap[event.Source]
+	if !ok {
+		source = &coapSource{}
+		r.coap[event.Source] = source
+	}
+
+	failed, reported := 0, 0
+	for i := 0; i < count; i++ {
+		size, answer, err := coapGet(conn, path)
+		if err != nil {
+			failed++
+		}
+		if source.observe(time.Now(), size, event.Event == "coap_discovery") {
+			reported++
+		}
+		source.answer(size, answer)
+		if step.IntervalMs > 0 && i < count-1 {
+			time.Sleep(time.Duration(step.IntervalMs) * time.Millisecond)
+		}
+	}
+
+	event.Count = count
+	event.Detail = fmt.Sprintf("%d of %d requests answered", count-failed, count)
+	err = nil
+	if failed == count {
+		err = fmt.Errorf("no answer to %d requests", count)
+	}
+	r.expect(event, err)
+
+	if reported > 0 {
+		flagged := event
+		flagged.Event = "amplification_attempt"
+		flagged.Log = fmt.Sprintf("event=amplification_attempt src=%s", event.Source)
+		flagged.Count, flagged.Detail = reported, "reason="+source.reason
+		r.expect(flagged, err)
+	}
+}
+
+// coapGet sends a GET and returns the size of the request on the wire and of
+// the payload of the answer, the two numbers the honeypot computes its ratio from
+func coapGet(conn *udpClient.Conn, path string) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), attackTimeout)
+	defer cancel()
+
+	req, err := conn.NewGetRequest(ctx, path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.ReleaseMessage(req)
+	resp, err := conn.Do(req)
+	size := 0
+	if data, merr := req.MarshalWithEncoder(coder.DefaultCoder); merr == nil {
+		size = len(data)
+	}
+	if err != nil {
+		return size, 0, err
+	}
+	body, err := resp.ReadBody()
+	return size, len(body), err
+}
+
+// mqttConnect opens an MQTT session as an identity, from its source address
+func (r *attackRun) mqttConnect(step AttackStep, id AttackIdentity, event *ExpectedEvent) (mqtt.Client, error) {
+	config := current().config
+	opts, err := mqttClientOptions(id.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	opts.SetUsername(id.Username)
+	opts.SetPassword(id.Password)
+	opts.SetDialer(sourceDialer(id, "tcp"))
+	opts.SetConnectTimeout(attackTimeout)
+
+	connect := ExpectedEvent{
+		Time:     time.Now(),
+		Step:     step.Name,
+		Identity: id.Name,
+		Source:   id.SourceIP,
+		Honeypot: "mqtt",
+		Target:   net.JoinHostPort(config.MQTT.Address, strconv.Itoa(config.MQTT.Port)),
+		Event:    "mqtt_connect",
+		Log:      fmt.Sprintf("as %s", id.ClientID),
+	}
+	*event = connect
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(attackTimeout) {
+		err = fmt.Errorf("timeout connecting to MQTT broker")
+	} else {
+		err = token.Error()
+	}
+	r.expect(connect, err)
+	return client, err
+}
+
+// mqttSubscribe subscribes to a topic, typically a wildcard, and counts what it receives
+func (r *attackRun) mqttSubscribe(step AttackStep, id AttackIdentity) {
+	var event ExpectedEvent
+	client, err := r.mqttConnect(step, id, &event)
+	if err != nil {
+		return
+	}
+	defer client.Disconnect(250)
+
+	duration := 5 * time.Second
+	if step.Duration != "" {
+		duration, _ = time.ParseDuration(step.Duration)
+	}
+	var mu sync.Mutex
+	received := 0
+	topics := make(map[string]bool)
+
+	event.Time = time.Now()
+	event.Event = "mqtt_subscribe"
+	event.Log = fmt.Sprintf("Received SUBSCRIBE from %s", id.ClientID)
+	token := client.Subscribe(step.Topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
+		mu.Lock()
+		received++
+		topics[msg.Topic()] = true
+		mu.Unlock()
+	})
+	if !token.WaitTimeout(attackTimeout) {
+		r.expect(event, fmt.Errorf("timeout subscribing to %s", step.Topic))
+		return
+	}
+	if err := token.Error(); err != nil {
+		r.expect(event, err)
+		return
+	}
+	time.Sleep(duration)
+	mu.Lock()
+	event.Detail = fmt.Sprintf("received %d messages on %d topics in %v", received, len(topics), duration)
+	mu.Unlock()
+	r.expect(event, nil)
+}
+
+// mqttPublish injects a message on a topic
+func (r *attackRun) mqttPublish(step AttackStep, id AttackIdentity) {
+	var event ExpectedEvent
+	client, err := r.mqttConnect(step, id, &event)
+	if err != nil {
+		return
+	}
+	defer client.Disconnect(250)
+
+	retain := 0
+	if step.Retain {
+		retain = 1
+	}
+	event.Time = time.Now()
+	event.Event = "mqtt_publish"
+	event.Log = fmt.Sprintf("Received PUBLISH from %s (d0, q0, r%d, m0, '%s'", id.ClientID, retain, step.Topic)
+	token := client.Publish(step.Topic, 0, step.Retain, step.Payload)
+	if !token.WaitTimeout(attackTimeout) {
+		err = fmt.Errorf("timeout publishing to %s", step.Topic)
+	} else {
+		err = token.Error()
+	}
+	r.expect(event, err)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// MetricSpec describes one metric a device type reports
+type MetricSpec struct {
+	Name       string      `json:"name"`
+	Unit       string      `json:"unit"`        // SenML unit, empty when there is none
+	Model      ModelConfig `json:"model"`       // how the value evolves, see ModelConfig
+	AlertAbove *float64    `json:"alert_above"` // an alarm is raised while the value is above this
+	AlertBelow *float64    `json:"alert_below"` // or below this
+	AlarmCode  int         `json:"alarm_code"`  // code of the high alarm, the low alarm is the next code
+	IdleBelow  *float64    `json:"idle_below"`  // the device is Idle while the value is below this
+}
+
+// DeviceTypeSpec is a device type of the catalogue. Metrics are sampled in
+// order, so a correlated metric should come after the metric it follows.
+type DeviceTypeSpec struct {
+	Description string       `json:"description"`
+	Metrics     []MetricSpec `json:"metrics"`
+	StartupS    int          `json:"startup_s"` // how long the device is Starting, 30 when not set
+}
+
+// builtinCatalogue holds the device types that ship with the generator, config
+// device_types add to them or replace them
+//
+//go:embed catalogue.json
+var builtinCatalogue []byte
+
+// loadCatalogue merges the configured device types over the built-in ones and validates them
+func loadCatalogue(configured map[string]DeviceTypeSpec) (map[string]DeviceTypeSpec, error) {
+	types := make(map[string]DeviceTypeSpec)
+	if err := json.Unmarshal(builtinCatalogue, &types); err != nil {
+		return nil, fmt.Errorf("could not parse built-in device catalogue: %v", err)
+	}
+	for name, spec := range configured {
+		types[name] = spec
+	}
+
+	for name, spec := range types {
+		if len(spec.Metrics) == 0 {
+			return nil, fmt.Errorf("device type %s has no metrics", name)
+		}
+		seen := make(map[string]bool)
+		for _, m := range spec.Metrics {
+			if m.Name == "" {
+				return nil, fmt.Errorf("device type %s has a metric without name", name)
+			}
+			if seen[m.Name] {
+				return nil, fmt.Errorf("device type %s has metric %s twice", name, m.Name)
+			}
+			seen[m.Name] = true
+			if err := validateModel(m.Model); err != nil {
+				return nil, fmt.Errorf("model for %s %s: %v", name, m.Name, err)
+			}
+		}
+	}
+	return types, nil
+}
+
+// deviceTypeNames returns the names of the catalogue in order
+func deviceTypeNames(types map[string]DeviceTypeSpec) []string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// metric returns the spec of a metric of the type
+func (t DeviceTypeSpec) metric(name string) (MetricSpec, bool) {
+	for _, m := range t.Metrics {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return MetricSpec{}, false
+}
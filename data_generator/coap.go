@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/message/pool"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	udpClient "github.com/plgd-dev/go-coap/v3/udp/client"
+)
+
+// coapPublisher publishes OT data to per-device resources on the CoAP server,
+// and the device state to a status resource below it whenever it changes
+type coapPublisher struct {
+	conn       *udpClient.Conn
+	address    string
+	lastStatus map[string]string // device -> state and alarms last sent
+}
+
+func (p *coapPublisher) Connect(ctx context.Context) error {
+	config := current().config
+	p.address = fmt.Sprintf("%s:%d", config.CoAP.Address, config.CoAP.Port)
+	conn, err := udp.Dial(p.address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to CoAP server on %s: %v", p.address, err)
+	}
+	p.conn = conn
+	p.lastStatus = make(map[string]string)
+	return nil
+}
+
+// coapPath is the resource of a device, mirroring the MQTT topic layout
+func coapPath(device *Device) string {
+	return fmt.Sprintf("/devices/%s/%s", device.Type, device.ID)
+}
+
+func (p *coapPublisher) Target(device *Device) string {
+	return coapPath(device)
+}
+
+func (p *coapPublisher) Publish(ctx context.Context, device *Device, data OTData) error {
+	config := current().config
+	path := coapPath(device)
+
+	payload, format, err := encodeOTData(data, config.CoAP.Format)
+	if err != nil {
+		return fmt.Errorf("failed to generate data for device %s: %v", device.ID, err)
+	}
+	if err := p.send(ctx, device, path, payload, format); err != nil {
+		return err
+	}
+
+	status := fmt.Sprint(data.Status, data.Alarms)
+	if p.lastStatus[device.ID] == status {
+		return nil
+	}
+	payload, format, err = encodeStatus(data, config.CoAP.Format)
+	if err != nil {
+		return fmt.Errorf("failed to generate status for device %s: %v", device.ID, err)
+	}
+	if err := p.send(ctx, device, path+"/status", payload, format); err != nil {
+		return err
+	}
+	p.lastStatus[device.ID] = status
+	return nil
+}
+
+// send puts or posts a payload to a resource of the CoAP server
+func (p *coapPublisher) send(ctx context.Context, device *Device, path string, payload []byte, format message.MediaType) error {
+	config := current().config
+	timeout := time.Duration(config.CoAP.TimeoutMs) * time.Millisecond
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var resp *pool.Message
+	var err error
+	if strings.EqualFold(config.CoAP.Method, "POST") {
+		resp, err = p.conn.Post(ctx, path, format, bytes.NewReader(payload))
+	} else {
+		resp, err = p.conn.Put(ctx, path, format, bytes.NewReader(payload))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send CoAP data for device %s to %s: %v", device.ID, p.address, err)
+	}
+	if resp.Code() != codes.Changed && resp.Code() != codes.Created {
+		return fmt.Errorf("CoAP server rejected data for device %s: %v", device.ID, resp.Code())
+	}
+	return nil
+}
+
+func (p *coapPublisher) Close() error {
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+func (p *coapPublisher) Health() error {
+	if p.conn == nil {
+		return errNotConnected
+	}
+	select {
+	case <-p.conn.Done():
+		return fmt.Errorf("connection to CoAP server closed")
+	default:
+		return nil
+	}
+}
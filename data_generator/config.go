@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	ossignal "os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var configPath = flag.String("config", "config.json", "Path of the configuration file, reloaded on SIGHUP and when it changes")
+
+// snapshot is the configuration and everything built from it. A reload builds
+// a new snapshot and swaps it in whole, so the API, the scheduler and the
+// publishers never see a half applied configuration and never race the reload.
+type snapshot struct {
+	config       *Config
+	catalogue    map[string]DeviceTypeSpec // every known device type by name
+	fleet        *Fleet
+	honeytokens  *honeytokenSet
+	registerMaps map[string]*RegisterMap
+	scenarios    *ScenarioSchedule
+	replay       *Replay
+}
+
+var running atomic.Pointer[snapshot]
+
+// current returns the snapshot in use. Code that reads several parts of it
+// should call it once, a reload may swap it in between.
+func current() *snapshot {
+	return running.Load()
+}
+
+// loadConfig reads a configuration file, applies the OTPOT_* environment
+// overrides and the defaults, and validates the result
+func loadConfig(path string) (Config, error) {
+	var c Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("could not read config file: %v", err)
+	}
+
+	// Unknown fields are rejected, a typo would otherwise silently fall back to a default
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return c, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+
+	if err := c.applyEnv(); err != nil {
+		return c, err
+	}
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return c, fmt.Errorf("invalid config file %s:\n%v", path, err)
+	}
+	return c, nil
+}
+
+// envOverride is an environment variable that replaces one config value
+type envOverride struct {
+	name   string
+	target interface{} // *string, *int, *bool or *[]string (comma separated)
+}
+
+// envOverrides lists the OTPOT_* variables, so credentials and addresses can come from Docker instead of the repo
+func (c *Config) envOverrides() []envOverride {
+	return []envOverride{
+		{"OTPOT_WEB_PORT", &c.Web.Port},
+		{"OTPOT_MQTT_ADDRESS", &c.MQTT.Address},
+		{"OTPOT_MQTT_PORT", &c.MQTT.Port},
+		{"OTPOT_MQTT_USERNAME", &c.MQTT.Username},
+		{"OTPOT_MQTT_PASSWORD", &c.MQTT.Password},
+		{"OTPOT_MQTT_CLIENT_ID_PREFIX", &c.MQTT.ClientIDPrefix},
+		{"OTPOT_MQTT_TLS", &c.MQTT.TLS.Enabled},
+		{"OTPOT_MQTT_TLS_CA_FILE", &c.MQTT.TLS.CAFile},
+		{"OTPOT_MQTT_TLS_CERT_FILE", &c.MQTT.TLS.CertFile},
+		{"OTPOT_MQTT_TLS_KEY_FILE", &c.MQTT.TLS.KeyFile},
+		{"OTPOT_MQTT_HOME_ASSISTANT", &c.MQTT.Discovery.HomeAssistant},
+		{"OTPOT_MQTT_HOMIE", &c.MQTT.Discovery.Homie},
+		{"OTPOT_COAP_ADDRESS", &c.CoAP.Address},
+		{"OTPOT_COAP_PORT", &c.CoAP.Port},
+		{"OTPOT_MODBUS_ADDRESS", &c.ModBus.Address},
+		{"OTPOT_MODBUS_PORT", &c.ModBus.Port},
+		{"OTPOT_MODBUS_REGISTER_MAP", &c.ModBus.RegisterMap},
+		{"OTPOT_SPARKPLUG_GROUP_ID", &c.Sparkplug.GroupID},
+		{"OTPOT_SPARKPLUG_EDGE_NODE_ID", &c.Sparkplug.EdgeNodeID},
+		{"OTPOT_SCENARIO_FILE", &c.ScenarioFile},
+		{"OTPOT_REPLAY_FILE", &c.Replay.File},
+		{"OTPOT_HONEYTOKENS", &c.Honeytokens.Enabled},
+		{"OTPOT_HONEYTOKEN_REGISTRY", &c.Honeytokens.Registry},
+		{"OTPOT_SERVICES", &c.Scheduler.Services},
+	}
+}
+
+// applyEnv overrides config values with the OTPOT_* variables that are set
+func (c *Config) applyEnv() error {
+	for _, o := range c.envOverrides() {
+		value, ok := os.LookupEnv(o.name)
+		if !ok {
+			continue
+		}
+		switch target := o.target.(type) {
+		case *string:
+			*target = value
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be a number, got %q", o.name, value)
+			}
+			*target = n
+		case *bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false, got %q", o.name, value)
+			}
+			*target = b
+		case *[]string:
+			*target = nil
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*target = append(*target, item)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// setDefaults fills in every setting the config file may leave out
+func (c *Config) setDefaults() {
+	if c.Web.Port == 0 {
+		c.Web.Port = 80
+	}
+	if c.MQTT.Port == 0 {
+		c.MQTT.Port = 1883
+	}
+	if c.MQTT.ClientIDPrefix == "" {
+		c.MQTT.ClientIDPrefix = "ot-"
+	}
+	if c.MQTT.KeepAliveS == 0 {
+		c.MQTT.KeepAliveS = 30
+	}
+	if c.Honeytokens.Registry == "" {
+		c.Honeytokens.Registry = "honeytokens.json"
+	}
+	if c.Honeytokens.Domain == "" {
+		c.Honeytokens.Domain = "plant.local"
+	}
+	if c.MQTT.Discovery.HomeAssistantPrefix == "" {
+		c.MQTT.Discovery.HomeAssistantPrefix = "homeassistant"
+	}
+	if c.CoAP.Port == 0 {
+		c.CoAP.Port = 5683
+	}
+	if c.CoAP.Method == "" {
+		c.CoAP.Method = "PUT"
+	}
+	if c.CoAP.Format == "" {
+		c.CoAP.Format = "json"
+	}
+	if c.CoAP.TimeoutMs == 0 {
+		c.CoAP.TimeoutMs = 2000
+	}
+	if c.ModBus.Port == 0 {
+		c.ModBus.Port = 502
+	}
+	if c.Sparkplug.GroupID == "" {
+		c.Sparkplug.GroupID = "Plant1"
+	}
+	if c.Sparkplug.EdgeNodeID == "" {
+		c.Sparkplug.EdgeNodeID = "Gateway01"
+	}
+	if c.Replay.Speed == 0 {
+		c.Replay.Speed = 1
+	}
+}
+
+// validate checks the settings the publishers depend on and reports every problem at once
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	for name, port := range map[string]int{"web.port": c.Web.Port, "mqtt.port": c.MQTT.Port, "coap.port": c.CoAP.Port, "modbus.port": c.ModBus.Port} {
+		check(port > 0 && port <= 65535, "%s %d is not a valid port", name, port)
+	}
+	check(c.MQTT.Address != "", "mqtt.address is required")
+	check(c.CoAP.Address != "", "coap.address is required")
+	check(c.ModBus.Address != "", "modbus.address is required")
+
+	check(c.MQTT.KeepAliveS > 0, "mqtt.keepalive_s must be positive")
+	check(c.MQTT.TLS.CertFile == "" || c.MQTT.TLS.KeyFile != "", "mqtt.tls.cert_file needs a key_file")
+	for name, qos := range map[string]byte{"data": c.MQTT.QoS.Data, "values": c.MQTT.QoS.Values, "status": c.MQTT.QoS.Status} {
+		check(qos <= 2, "mqtt.qos.%s %d must be 0, 1 or 2", name, qos)
+	}
+	check(!strings.ContainsAny(c.MQTT.Discovery.HomeAssistantPrefix, "#+"), "mqtt.discovery.home_assistant_prefix %q must not contain wildcards", c.MQTT.Discovery.HomeAssistantPrefix)
+
+	check(strings.EqualFold(c.CoAP.Method, "PUT") || strings.EqualFold(c.CoAP.Method, "POST"), "coap.method %q must be PUT or POST", c.CoAP.Method)
+	check(validPayloadFormat(c.CoAP.Format), "coap.format %q must be json, cbor, senml+json or senml+cbor", c.CoAP.Format)
+	check(c.CoAP.TimeoutMs > 0, "coap.timeout_ms must be positive")
+
+	// Sparkplug ids are topic levels
+	for name, id := range map[string]string{"group_id": c.Sparkplug.GroupID, "edge_node_id": c.Sparkplug.EdgeNodeID} {
+		check(!strings.ContainsAny(id, "/+#"), "sparkplug.%s %q may not contain /, + or #", name, id)
+	}
+
+	check(c.Replay.Speed > 0, "replay.speed must be positive")
+	check(c.Replay.Format == "" || c.Replay.Format == "csv" || c.Replay.Format == "jsonl", "replay.format %q must be csv or jsonl", c.Replay.Format)
+	check(c.Alarms.AutoAckS >= 0, "alarms.auto_ack_s may not be negative")
+
+	for _, service := range c.Scheduler.Services {
+		_, ok := publishersByID[strings.ToLower(service)]
+		check(ok, "scheduler.services has unknown service %q", service)
+	}
+	for service, ms := range c.Scheduler.IntervalMs {
+		_, ok := publishersByID[service]
+		check(ok, "scheduler.interval_ms has unknown service %q", service)
+		check(ms >= 0, "scheduler.interval_ms of %s may not be negative", service)
+	}
+
+	for _, d := range c.Fleet {
+		for _, protocol := range d.Protocols {
+			_, ok := publishersByID[strings.ToLower(protocol)]
+			check(ok, "fleet device %s has unknown protocol %q", d.ID, protocol)
+		}
+		check(d.IntervalMs >= 0, "fleet device %s has a negative interval_ms", d.ID)
+	}
+
+	// Map iteration makes the order random, keep the report stable between runs
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the file changes
+func watchConfig(path string) {
+	reload := make(chan struct{}, 1)
+	trigger := func() {
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	ossignal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			trigger()
+		}
+	}()
+
+	// The directory is watched rather than the file, editors and ConfigMaps replace the file on save
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(path))
+	}
+	if err != nil {
+		log.Printf("Not watching %s for changes, reload with SIGHUP: %v", path, err)
+	} else {
+		go func() {
+			for {
+				select {
+				case event, ok := <-watcher.Events:
+					if !ok {
+						return
+					}
+					if filepath.Clean(event.Name) == filepath.Clean(path) && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+						trigger()
+					}
+				case err, ok := <-watcher.Errors:
+					if !ok {
+						return
+					}
+					log.Printf("Error watching %s: %v", path, err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for range reload {
+			// A save is often several writes, give the file a moment to settle
+			time.Sleep(500 * time.Millisecond)
+			select {
+			case <-reload:
+			default:
+			}
+			reloadConfig(path)
+		}
+	}()
+}
+
+var reloadMu sync.Mutex
+
+// reloadConfig applies a changed configuration without restarting. An invalid
+// file is logged and the running configuration is kept.
+func reloadConfig(path string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := loadConfig(path)
+	if err != nil {
+		log.Printf("Keeping the running configuration: %v", err)
+		return
+	}
+	previous := current()
+	if reflect.DeepEqual(&next, previous.config) {
+		return
+	}
+
+	// Build everything that can fail before anything is swapped
+	s := *previous
+	s.config = &next
+	fleetChanged := !reflect.DeepEqual(next.Fleet, previous.config.Fleet) || !reflect.DeepEqual(next.Models, previous.config.Models) || !reflect.DeepEqual(next.DeviceTypes, previous.config.DeviceTypes)
+	if fleetChanged {
+		if s.catalogue, err = loadCatalogue(next.DeviceTypes); err != nil {
+			log.Printf("Keeping the running configuration, error loading device catalogue: %v", err)
+			return
+		}
+		if s.fleet, err = newFleet(next.Fleet, next.Models, s.catalogue); err != nil {
+			log.Printf("Keeping the running configuration, error creating device fleet: %v", err)
+			return
+		}
+	}
+	s.honeytokens = plantHoneytokens(next.Honeytokens, s.fleet)
+	if s.registerMaps, err = loadRegisterMaps(next.ModBus.RegisterMap, s.fleet, s.honeytokens); err != nil {
+		log.Printf("Keeping the running configuration, error loading register map: %v", err)
+		return
+	}
+	if next.ScenarioFile != previous.config.ScenarioFile {
+		if s.scenarios, err = loadScenarios(next.ScenarioFile, s.fleet, time.Now()); err != nil {
+			log.Printf("Keeping the running configuration, error loading scenarios: %v", err)
+			return
+		}
+	}
+	if fleetChanged || !reflect.DeepEqual(next.Replay, previous.config.Replay) {
+		if s.replay, err = loadReplay(next.Replay, s.fleet, time.Now()); err != nil {
+			log.Printf("Keeping the running configuration, error loading replay: %v", err)
+			return
+		}
+	}
+	if next.Web.Port != previous.config.Web.Port {
+		log.Printf("Changing the web port to %d takes a restart", next.Web.Port)
+	}
+
+	// Holding every publisher waits for running rounds and keeps new ones out while the snapshot is swapped
+	for _, e := range publishers {
+		e.mu.Lock()
+	}
+	running.Store(&s)
+	for _, e := range publishers {
+		// Publishers whose connection settings changed reconnect on their next round
+		if fleetChanged || !reflect.DeepEqual(connectionSettings(previous.config, e.name), connectionSettings(s.config, e.name)) {
+			if err := e.publisher.Close(); err != nil {
+				log.Printf("Error closing %s: %v", e.displayName, err)
+			}
+			e.updateHealth()
+		}
+		e.mu.Unlock()
+	}
+
+	rescheduleServices(previous.config, s.config)
+	log.Printf("Reloaded configuration from %s", path)
+}
+
+// connectionSettings returns the part of the config a publisher connects with
+func connectionSettings(c *Config, service string) interface{} {
+	switch service {
+	case "mqtt":
+		// The config topic with the honeytokens is published on connect
+		return []interface{}{c.MQTT, c.Honeytokens}
+	case "sparkplug":
+		return []interface{}{c.MQTT, c.Sparkplug}
+	case "modbus":
+		return c.ModBus
+	case "coap":
+		return c.CoAP
+	}
+	return nil
+}
+
+// rescheduleServices starts and stops services for a changed scheduler config,
+// services started or stopped over the API are left alone unless their config changed
+func rescheduleServices(previous, next *Config) {
+	wasEnabled := make(map[string]bool)
+	for _, service := range enabledServices(previous) {
+		wasEnabled[service] = true
+	}
+
+	enabled := make(map[string]bool)
+	for _, service := range enabledServices(next) {
+		enabled[service] = true
+		if !wasEnabled[service] || previous.Scheduler.IntervalMs[service] != next.Scheduler.IntervalMs[service] {
+			scheduler.Start(service, serviceInterval(service))
+		}
+	}
+	for service := range wasEnabled {
+		if !enabled[service] {
+			scheduler.Stop(service)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the shipped config.json with edit applied to a temporary file
+func writeConfig(t *testing.T, edit func(string) string) string {
+	t.Helper()
+	data, err := os.ReadFile("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(edit(string(data))), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigCoAPFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		valid  bool
+	}{
+		{"json", true},
+		{"cbor", true},
+		{"senml+json", true},
+		{"senml+cbor", true},
+		{"", true}, // defaults to json
+		{"xml", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			path := writeConfig(t, func(s string) string {
+				return strings.Replace(s, `"format": "json"`, `"format": "`+tt.format+`"`, 1)
+			})
+			c, err := loadConfig(path)
+			switch {
+			case tt.valid && err != nil:
+				t.Fatalf("loadConfig() = %v, want no error", err)
+			case !tt.valid && (err == nil || !strings.Contains(err.Error(), "coap.format")):
+				t.Fatalf("loadConfig() = %v, want a coap.format error", err)
+			case tt.valid && tt.format != "" && c.CoAP.Format != tt.format:
+				t.Errorf("coap.format = %q, want %q", c.CoAP.Format, tt.format)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(string) string
+		want string // part of the error
+	}{
+		{
+			name: "unknown field",
+			edit: func(s string) string { return strings.Replace(s, `"keepalive_s"`, `"keep_alive_s"`, 1) },
+			want: "unknown field",
+		},
+		{
+			name: "bad port and method reported together",
+			edit: func(s string) string {
+				s = strings.Replace(s, `"port": 5683`, `"port": 70000`, 1)
+				return strings.Replace(s, `"method": "PUT"`, `"method": "GET"`, 1)
+			},
+			want: "coap.method \"GET\" must be PUT or POST\ncoap.port 70000 is not a valid port",
+		},
+		{
+			name: "unknown protocol",
+			edit: func(s string) string {
+				return strings.Replace(s, `"protocols": ["mqtt", "coap"]`, `"protocols": ["mqtt", "bacnet"]`, 1)
+			},
+			want: `has unknown protocol "bacnet"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, tt.edit))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadConfig() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("OTPOT_COAP_PORT", "5684")
+	t.Setenv("OTPOT_MQTT_TLS", "true")
+	t.Setenv("OTPOT_SERVICES", "mqtt,coap")
+
+	c, err := loadConfig(writeConfig(t, func(s string) string { return s }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CoAP.Port != 5684 || !c.MQTT.TLS.Enabled || strings.Join(c.Scheduler.Services, ",") != "mqtt,coap" {
+		t.Errorf("loadConfig() = coap.port %d, mqtt.tls %v, services %v, want the environment values", c.CoAP.Port, c.MQTT.TLS.Enabled, c.Scheduler.Services)
+	}
+}
+
+// TestShippedSnapshot builds a snapshot from the shipped files the way main does
+func TestShippedSnapshot(t *testing.T) {
+	c, err := loadConfig("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &snapshot{config: &c, honeytokens: &honeytokenSet{}}
+	if s.catalogue, err = loadCatalogue(c.DeviceTypes); err != nil {
+		t.Fatal(err)
+	}
+	if s.fleet, err = newFleet(c.Fleet, c.Models, s.catalogue); err != nil {
+		t.Fatal(err)
+	}
+	if s.registerMaps, err = loadRegisterMaps(c.ModBus.RegisterMap, s.fleet, s.honeytokens); err != nil {
+		t.Fatal(err)
+	}
+	if s.scenarios, err = loadScenarios(c.ScenarioFile, s.fleet, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if s.replay, err = loadReplay(c.Replay, s.fleet, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	running.Store(s)
+	t.Cleanup(func() { running.Store(nil) })
+
+	// Every reading of every device encodes in every CoAP format
+	for _, d := range s.fleet.devices {
+		data := d.Sample(time.Now())
+		for _, format := range []string{"json", "cbor", "senml+json", "senml+cbor"} {
+			if _, _, err := encodeOTData(data, format); err != nil {
+				t.Errorf("encodeOTData(%s, %s) = %v", d.ID, format, err)
+			}
+		}
+	}
+}
+
+func TestReloadConfigKeepsSnapshotOnError(t *testing.T) {
+	previous := &snapshot{config: &Config{}}
+	running.Store(previous)
+	t.Cleanup(func() { running.Store(nil) })
+
+	reloadConfig(writeConfig(t, func(s string) string { return strings.Replace(s, `"format": "json"`, `"format": "xml"`, 1) }))
+	if current() != previous {
+		t.Error("reloadConfig() swapped the snapshot for an invalid file")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// haSensor is the Home Assistant MQTT discovery config of one sensor
+type haSensor struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"` // online and offline, what Home Assistant expects by default
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Options           []string `json:"options,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers   []string `json:"identifiers"`
+	Name          string   `json:"name"`
+	Model         string   `json:"model"`
+	SuggestedArea string   `json:"suggested_area,omitempty"`
+	ConfigURL     string   `json:"configuration_url,omitempty"`
+}
+
+// haUnit maps a SenML unit of the catalogue onto the unit, device class and
+// state class Home Assistant uses for it
+func haUnit(unit string) (string, string, string) {
+	switch unit {
+	case "Cel":
+		return "°C", "temperature", "measurement"
+	case "%RH":
+		return "%", "humidity", "measurement"
+	case "1/min":
+		return "rpm", "", "measurement"
+	case "A":
+		return "A", "current", "measurement"
+	case "V":
+		return "V", "voltage", "measurement"
+	case "W", "kW":
+		return unit, "power", "measurement"
+	case "Hz":
+		return "Hz", "frequency", "measurement"
+	case "kWh":
+		return "kWh", "energy", "total_increasing"
+	case "m3":
+		// Stored volume goes up and down, a total would read every drop as a meter reset
+		return "m³", "volume_storage", "measurement"
+	case "ms":
+		return "ms", "duration", "measurement"
+	}
+	return unit, "", "measurement"
+}
+
+// discoveryState is what a device was last announced with, so what a reload
+// turns off can be cleared from the broker
+type discoveryState struct {
+	homeAssistant string // prefix of the Home Assistant configs, empty when none were published
+	homie         bool
+}
+
+// haSensors returns the Home Assistant sensors of a device: every metric, the
+// state and the alarm code. They read the retained values the MQTT publisher
+// already keeps under the device topic.
+func haSensors(s *snapshot, device *Device) []haSensor {
+	base := mqttTopic(device)
+	ha := haDevice{Identifiers: []string{"ot_" + device.ID}, Name: device.ID, Model: device.Type, SuggestedArea: device.Location}
+	if url := s.honeytokens.token(device.ID, tokenURL); url != nil {
+		ha.ConfigURL = url.Value
+	}
+	sensor := func(name string) haSensor {
+		return haSensor{
+			Name:              name,
+			UniqueID:          device.ID + "_" + name,
+			StateTopic:        base + "/" + name,
+			AvailabilityTopic: base + "/status",
+			Device:            ha,
+		}
+	}
+
+	sensors := make([]haSensor, 0, len(device.metrics)+2)
+	for _, m := range device.metrics {
+		s := sensor(m.Name)
+		s.Unit, s.DeviceClass, s.StateClass = haUnit(m.Unit)
+		sensors = append(sensors, s)
+	}
+	state := sensor("state")
+	state.DeviceClass, state.Options = "enum", deviceStates
+	return append(sensors, state, sensor("alarm_code"))
+}
+
+func haConfigTopic(prefix string, device *Device, sensor string) string {
+	return fmt.Sprintf("%s/sensor/%s/%s/config", prefix, device.ID, sensor)
+}
+
+// publishHomeAssistant publishes the retained discovery config of every sensor of a device
+func publishHomeAssistant(client mqtt.Client, device *Device) {
+	s := current()
+	for _, sensor := range haSensors(s, device) {
+		payload, _ := json.Marshal(sensor)
+		client.Publish(haConfigTopic(s.config.MQTT.Discovery.HomeAssistantPrefix, device, sensor.Name), s.config.MQTT.QoS.Status, true, payload)
+	}
+}
+
+// clearHomeAssistant removes the discovery configs of a device under prefix, Home Assistant drops its sensors
+func clearHomeAssistant(client mqtt.Client, device *Device, prefix string) {
+	s := current()
+	for _, sensor := range haSensors(s, device) {
+		client.Publish(haConfigTopic(prefix, device, sensor.Name), s.config.MQTT.QoS.Status, true, "")
+	}
+}
+
+// homieID turns a name into a Homie topic ID: lowercase letters, digits and hyphens
+func homieID(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, name)
+}
+
+// homieTopic is the topic of a Homie device, "homie/<device>"
+func homieTopic(device *Device) string {
+	return "homie/" + homieID(device.ID)
+}
+
+// homieNode is the one node of a Homie device, named after its type
+func homieNode(device *Device) string {
+	return homieTopic(device) + "/" + homieID(device.Type)
+}
+
+// homieAttributes returns the retained attributes of a device after the Homie 4
+// convention, with a node holding a property per metric, the state and the alarm code
+func homieAttributes(device *Device) [][2]string {
+	base, node := homieTopic(device), homieNode(device)
+	name := device.ID
+	if device.Location != "" {
+		name += " " + device.Location
+	}
+	attributes := [][2]string{
+		{base + "/$homie", "4.0.0"},
+		{base + "/$name", name},
+		{base + "/$state", "init"},
+		{base + "/$nodes", homieID(device.Type)},
+		{node + "/$name", device.Type},
+		{node + "/$type", device.Type},
+	}
+
+	var properties []string
+	for _, m := range device.metrics {
+		id := homieID(m.Name)
+		properties = append(properties, id)
+		attributes = append(attributes, [2]string{node + "/" + id + "/$name", m.Name}, [2]string{node + "/" + id + "/$datatype", "float"})
+		if m.Unit != "" {
+			unit, _, _ := haUnit(m.Unit)
+			attributes = append(attributes, [2]string{node + "/" + id + "/$unit", unit})
+		}
+	}
+	properties = append(properties, "state", "alarm-code")
+	attributes = append(attributes,
+		[2]string{node + "/state/$name", "state"},
+		[2]string{node + "/state/$datatype", "enum"},
+		[2]string{node + "/state/$format", strings.Join(deviceStates, ",")},
+		[2]string{node + "/alarm-code/$name", "alarm_code"},
+		[2]string{node + "/alarm-code/$datatype", "integer"},
+		[2]string{node + "/$properties", strings.Join(properties, ",")},
+		[2]string{base + "/$state", "ready"})
+	return attributes
+}
+
+// publishHomie announces a device on its Homie session
+func publishHomie(client mqtt.Client, device *Device) {
+	for _, a := range homieAttributes(device) {
+		client.Publish(a[0], current().config.MQTT.QoS.Status, true, a[1])
+	}
+}
+
+// clearHomie removes the attributes and property values of a device, which is how Homie deletes a device
+func clearHomie(client mqtt.Client, device *Device) {
+	qos := current().config.MQTT.QoS.Status
+	for _, a := range homieAttributes(device) {
+		client.Publish(a[0], qos, true, "")
+	}
+	for topic := range homieValues(device, OTData{}) {
+		client.Publish(topic, qos, true, "")
+	}
+	for _, m := range device.metrics {
+		client.Publish(homieNode(device)+"/"+homieID(m.Name), qos, true, "")
+	}
+}
+
+// homieValues returns the retained Homie property values of a reading by topic
+func homieValues(device *Device, data OTData) map[string]string {
+	node := homieNode(device)
+	values := map[string]string{
+		node + "/state":      data.Status,
+		node + "/alarm-code": strconv.Itoa(data.AlarmCode),
+	}
+	for name, value := range data.Metrics {
+		values[node+"/"+homieID(name)] = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return values
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seededDryRun runs a dry run of a small fleet with a seed and returns what it wrote
+func seededDryRun(t *testing.T, s int64, format string) string {
+	t.Helper()
+	output := filepath.Join(t.TempDir(), "out")
+	*dryRunFormat, *dryRunOutput, *dryRunDuration = format, output, time.Minute
+	t.Cleanup(func() { *dryRunFormat, *dryRunOutput, *dryRunDuration = "", "-", time.Hour })
+
+	// Correlated models fall back on what the plant reported, a new run starts without it
+	plant.Lock()
+	plant.values = make(map[string]map[string]float64)
+	plant.Unlock()
+	rng.Seed(s)
+
+	types, err := loadCatalogue(nil)
+	if err != nil {
+		t.Fatalf("loadCatalogue() = %v", err)
+	}
+	f, err := newFleet([]DeviceConfig{
+		{ID: "Flow-01", Type: "Flow", IntervalMs: 10000},
+		{ID: "Power-01", Type: "Power", IntervalMs: 15000},
+		{ID: "TH-01", Type: "TempHumidity", IntervalMs: 20000},
+	}, nil, types)
+	if err != nil {
+		t.Fatalf("newFleet() = %v", err)
+	}
+	running.Store(&snapshot{config: &Config{}, fleet: f, scenarios: &ScenarioSchedule{}})
+	t.Cleanup(func() { running.Store(nil) })
+	if err := dryRun(seededStart); err != nil {
+		t.Fatalf("dryRun() = %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDryRunSeeded(t *testing.T) {
+	first := seededDryRun(t, 42, "jsonl")
+	if again := seededDryRun(t, 42, "jsonl"); again != first {
+		t.Errorf("the same seed gave different output:\n%s\n%s", first, again)
+	}
+	if other := seededDryRun(t, 43, "jsonl"); other == first {
+		t.Error("another seed gave the same output")
+	}
+}
+
+func TestDryRunClock(t *testing.T) {
+	// A minute of devices every 10, 15 and 20 seconds, in time order and ties in fleet order
+	want := []struct {
+		device string
+		offset time.Duration
+	}{
+		{"Flow-01", 0}, {"Power-01", 0}, {"TH-01", 0},
+		{"Flow-01", 10 * time.Second},
+		{"Power-01", 15 * time.Second},
+		{"Flow-01", 20 * time.Second}, {"TH-01", 20 * time.Second},
+		{"Flow-01", 30 * time.Second}, {"Power-01", 30 * time.Second},
+		{"Flow-01", 40 * time.Second}, {"TH-01", 40 * time.Second},
+		{"Power-01", 45 * time.Second},
+		{"Flow-01", 50 * time.Second},
+	}
+
+	lines := strings.Split(strings.TrimSpace(seededDryRun(t, 1, "jsonl")), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("dry run wrote %d readings, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		var data OTData
+		if err := json.Unmarshal([]byte(line), &data); err != nil {
+			t.Fatalf("reading %d: %v", i, err)
+		}
+		if data.DeviceID != want[i].device || !data.Timestamp.Equal(seededStart.Add(want[i].offset)) {
+			t.Errorf("reading %d is %s at %s, want %s at %s", i, data.DeviceID, data.Timestamp.Format(time.RFC3339), want[i].device, seededStart.Add(want[i].offset).Format(time.RFC3339))
+		}
+	}
+}
+
+func TestDryRunCSV(t *testing.T) {
+	out := seededDryRun(t, 1, "csv")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	// A column for every metric of the fleet, in fleet and catalogue order
+	header := "timestamp,device_id,device_type,location,flow_rate,power_consumption,temperature,humidity,status,alarm_code"
+	if lines[0] != header {
+		t.Errorf("header = %s, want %s", lines[0], header)
+	}
+	if len(lines) != 14 {
+		t.Errorf("csv has %d lines, want a header and 13 readings", len(lines))
+	}
+	columns := strings.Count(header, ",") + 1
+	for _, line := range lines[1:] {
+		if fields := strings.Count(line, ",") + 1; fields != columns {
+			t.Errorf("row %q has %d fields, want %d", line, fields, columns)
+		}
+	}
+	// Metrics the device does not report stay empty
+	if !strings.HasPrefix(lines[1], "2024-01-01T00:00:00Z,Flow-01,Flow,,") || !strings.Contains(lines[1], ",,,,") {
+		t.Errorf("first row = %s, want Flow-01 with only flow_rate", lines[1])
+	}
+}
+
+func TestDryRunStart(t *testing.T) {
+	defer func(from string, s int64) { *dryRunFrom, *seed = from, s }(*dryRunFrom, *seed)
+	tests := []struct {
+		from    string
+		seed    int64
+		want    time.Time
+		wantErr bool
+	}{
+		{"2023-06-01T12:00:00Z", 0, time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{"2023-06-01T12:00:00Z", 7, time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{"", 7, seededStart, false},
+		{"yesterday", 0, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		*dryRunFrom, *seed = tt.from, tt.seed
+		got, err := dryRunStart()
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !got.Equal(tt.want)) {
+			t.Errorf("dryRunStart() with -start %q -seed %d = %v, %v, want %v", tt.from, tt.seed, got, err, tt.want)
+		}
+	}
+}
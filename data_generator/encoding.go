@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/plgd-dev/go-coap/v3/message"
+)
+
+// senmlRecord is a single SenML (RFC 8428) record, the CBOR labels are the integer keys from the RFC
+type senmlRecord struct {
+	BaseName    string   `json:"bn,omitempty" cbor:"-2,keyasint,omitempty"`
+	BaseTime    float64  `json:"bt,omitempty" cbor:"-3,keyasint,omitempty"`
+	Name        string   `json:"n,omitempty" cbor:"0,keyasint,omitempty"`
+	Unit        string   `json:"u,omitempty" cbor:"1,keyasint,omitempty"`
+	Value       *float64 `json:"v,omitempty" cbor:"2,keyasint,omitempty"`
+	StringValue *string  `json:"vs,omitempty" cbor:"3,keyasint,omitempty"`
+}
+
+// toSenML converts OTData into a SenML pack, one record per metric in catalogue order with its unit
+func toSenML(data OTData) []senmlRecord {
+	var records []senmlRecord
+	for _, m := range current().catalogue[data.DeviceType].Metrics {
+		if value, ok := data.Metrics[m.Name]; ok {
+			records = append(records, senmlRecord{Name: m.Name, Unit: m.Unit, Value: &value})
+		}
+	}
+	records = append(records, statusSenML(data)...)
+
+	records[0].BaseName = fmt.Sprintf("urn:dev:ops:%s:", data.DeviceID)
+	records[0].BaseTime = float64(data.Timestamp.UnixNano()) / float64(time.Second)
+	return records
+}
+
+// statusSenML returns the state and alarm code of a reading as SenML records
+func statusSenML(data OTData) []senmlRecord {
+	status := data.Status
+	code := float64(data.AlarmCode)
+	return []senmlRecord{{Name: "status", StringValue: &status}, {Name: "alarm_code", Value: &code}}
+}
+
+// deviceStatus is the state part of a reading, for protocols that publish it as a resource of its own
+type deviceStatus struct {
+	Timestamp time.Time `json:"timestamp"`
+	DeviceID  string    `json:"device_id"`
+	Status    string    `json:"status"`
+	AlarmCode int       `json:"alarm_code"`
+	Alarms    []Alarm   `json:"alarms"`
+}
+
+// encodeOTData serialises OTData in one of the supported payload formats and returns the matching CoAP content format
+func encodeOTData(data OTData, format string) ([]byte, message.MediaType, error) {
+	if strings.HasPrefix(format, "senml") {
+		return encodePayload(toSenML(data), format)
+	}
+	return encodePayload(data, format)
+}
+
+// encodeStatus serialises the state and alarms of a reading like encodeOTData
+func encodeStatus(data OTData, format string) ([]byte, message.MediaType, error) {
+	if strings.HasPrefix(format, "senml") {
+		records := statusSenML(data)
+		records[0].BaseName = fmt.Sprintf("urn:dev:ops:%s:", data.DeviceID)
+		records[0].BaseTime = float64(data.Timestamp.UnixNano()) / float64(time.Second)
+		return encodePayload(records, format)
+	}
+	return encodePayload(deviceStatus{data.Timestamp, data.DeviceID, data.Status, data.AlarmCode, data.Alarms}, format)
+}
+
+// validPayloadFormat reports whether encodePayload knows a format, without encoding anything
+func validPayloadFormat(format string) bool {
+	switch format {
+	case "", "json", "cbor", "senml+json", "senml+cbor":
+		return true
+	}
+	return false
+}
+
+func encodePayload(v interface{}, format string) ([]byte, message.MediaType, error) {
+	switch format {
+	case "", "json":
+		payload, err := json.Marshal(v)
+		return payload, message.AppJSON, err
+	case "cbor":
+		payload, err := cbor.Marshal(v)
+		return payload, message.AppCBOR, err
+	case "senml+json":
+		payload, err := json.Marshal(v)
+		return payload, message.AppSenmlJSON, err
+	case "senml+cbor":
+		payload, err := cbor.Marshal(v)
+		return payload, message.AppSenmlCbor, err
+	}
+	return nil, 0, fmt.Errorf("unknown payload format %q", format)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PublishEvent is one reading sent over a service, or an error of that service
+type PublishEvent struct {
+	Time       time.Time          `json:"time"`
+	Service    string             `json:"service"`
+	Device     string             `json:"device,omitempty"`
+	DeviceType string             `json:"device_type,omitempty"`
+	Target     string             `json:"target,omitempty"` // topic, registers or resource path the reading went to
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+	Status     string             `json:"status,omitempty"`
+	AlarmCode  int                `json:"alarm_code,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// targeter is implemented by publishers that can tell where a device is published
+type targeter interface {
+	Target(device *Device) string
+}
+
+// eventBacklog is how many recent events a new subscriber gets first
+const eventBacklog = 500
+
+// eventHub fans publish events out to every subscriber. A subscriber that
+// falls behind misses events rather than slowing the publishers down.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan PublishEvent]bool
+	recent      []PublishEvent
+}
+
+var events = &eventHub{subscribers: make(map[chan PublishEvent]bool)}
+
+// Publish sends an event to every subscriber
+func (h *eventHub) Publish(e PublishEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.recent = append(h.recent, e)
+	if len(h.recent) > eventBacklog {
+		h.recent = h.recent[len(h.recent)-eventBacklog:]
+	}
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of new events and the recent events before them
+func (h *eventHub) Subscribe() (chan PublishEvent, []PublishEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan PublishEvent, 64)
+	h.subscribers[ch] = true
+	return ch, append([]PublishEvent(nil), h.recent...)
+}
+
+func (h *eventHub) Unsubscribe(ch chan PublishEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, ch)
+}
+
+// publishEvent records what a publisher did with a reading of a device
+func publishEvent(e *publisherEntry, device *Device, data OTData, err error) {
+	event := PublishEvent{
+		Time:       time.Now(),
+		Service:    e.name,
+		Device:     device.ID,
+		DeviceType: device.Type,
+		Metrics:    data.Metrics,
+		Status:     data.Status,
+		AlarmCode:  data.AlarmCode,
+	}
+	if t, ok := e.publisher.(targeter); ok {
+		event.Target = t.Target(device)
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	events.Publish(event)
+}
+
+// keepAliveInterval is how often an idle event stream gets a comment, so proxies keep it open
+const keepAliveInterval = 15 * time.Second
+
+// eventsHandler streams publish events as server-sent events, starting with
+// the recent ones. ?device= and ?service= limit the stream to one device or service.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	device := r.URL.Query().Get("device")
+	service := r.URL.Query().Get("service")
+
+	ch, recent := events.Subscribe()
+	defer events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e PublishEvent) {
+		if (device != "" && e.Device != device) || (service != "" && e.Service != service) {
+			return
+		}
+		payload, _ := json.Marshal(e)
+		fmt.Fprintf(w, "data: %s\n\n", payload)
+	}
+	for _, e := range recent {
+		send(e)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-ch:
+			send(e)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
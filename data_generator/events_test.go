@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetEvents gives a test a hub of its own
+func resetEvents(t *testing.T) {
+	previous := events
+	events = &eventHub{subscribers: make(map[chan PublishEvent]bool)}
+	t.Cleanup(func() { events = previous })
+}
+
+func TestEventHubBacklog(t *testing.T) {
+	resetEvents(t)
+	for i := 0; i < eventBacklog+10; i++ {
+		events.Publish(PublishEvent{Device: "D", AlarmCode: i})
+	}
+
+	ch, recent := events.Subscribe()
+	defer events.Unsubscribe(ch)
+	if len(recent) != eventBacklog || recent[0].AlarmCode != 10 || recent[len(recent)-1].AlarmCode != eventBacklog+9 {
+		t.Errorf("backlog holds %d events from %d to %d, want the last %d", len(recent), recent[0].AlarmCode, recent[len(recent)-1].AlarmCode, eventBacklog)
+	}
+
+	// A subscriber that does not keep up misses events, publishing never blocks
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2*cap(ch); i++ {
+			events.Publish(PublishEvent{Device: "D"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a full subscriber")
+	}
+	if len(ch) != cap(ch) {
+		t.Errorf("subscriber got %d events, want its buffer of %d", len(ch), cap(ch))
+	}
+
+	events.Unsubscribe(ch)
+	events.Publish(PublishEvent{Device: "D"})
+	if len(ch) != cap(ch) {
+		t.Error("an unsubscribed channel still got events")
+	}
+}
+
+func TestPublishEvent(t *testing.T) {
+	resetEvents(t)
+	device := &Device{ID: "Flow-01", Type: "Flow"}
+	data := OTData{Status: stateFault, AlarmCode: 100, Metrics: map[string]float64{"flow_rate": 12.5}}
+	publishEvent(publishersByID["coap"], device, data, nil)
+	publishEvent(publishersByID["coap"], device, data, errors.New("timeout"))
+
+	_, recent := events.Subscribe()
+	if len(recent) != 2 {
+		t.Fatalf("got %d events, want 2", len(recent))
+	}
+	e := recent[0]
+	if e.Service != "coap" || e.Device != "Flow-01" || e.DeviceType != "Flow" || e.Target != "/devices/Flow/Flow-01" ||
+		e.Status != stateFault || e.AlarmCode != 100 || e.Metrics["flow_rate"] != 12.5 || e.Error != "" {
+		t.Errorf("event = %+v", e)
+	}
+	if recent[1].Error != "timeout" {
+		t.Errorf("error event = %+v, want error timeout", recent[1])
+	}
+}
+
+// readEvents reads n server-sent events from a stream
+func readEvents(t *testing.T, r *bufio.Reader, n int) []PublishEvent {
+	t.Helper()
+	var got []PublishEvent
+	for len(got) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var e PublishEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+			t.Fatalf("event %q: %v", line, err)
+		}
+		got = append(got, e)
+	}
+	return got
+}
+
+func TestEventsHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string     // service/device of the events streamed, backlog first
+		end   PublishEvent // matches the filter, reading up to it shows nothing else was sent
+	}{
+		{"everything", "", []string{"mqtt/A", "coap/B", "mqtt/B", "coap/A"}, PublishEvent{Service: "coap", Device: "A"}},
+		{"one device", "?device=B", []string{"coap/B", "mqtt/B"}, PublishEvent{Service: "coap", Device: "B"}},
+		{"one service", "?service=coap", []string{"coap/B", "coap/A"}, PublishEvent{Service: "coap", Device: "A"}},
+		{"device and service", "?device=A&service=coap", []string{"coap/A"}, PublishEvent{Service: "coap", Device: "A"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetEvents(t)
+			events.Publish(PublishEvent{Service: "mqtt", Device: "A"})
+			events.Publish(PublishEvent{Service: "coap", Device: "B"})
+
+			server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+			defer server.Close()
+			resp, err := http.Get(server.URL + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("Content-Type = %s, want text/event-stream", ct)
+			}
+
+			// The headers arrive once the handler subscribed, so these events go out live
+			events.Publish(PublishEvent{Service: "mqtt", Device: "B"})
+			events.Publish(PublishEvent{Service: "coap", Device: "A"})
+			tt.end.Status = "end"
+			events.Publish(tt.end)
+
+			stream := readEvents(t, bufio.NewReader(resp.Body), len(tt.want)+1)
+			var got []string
+			for _, e := range stream[:len(stream)-1] {
+				got = append(got, e.Service+"/"+e.Device)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("streamed %v, want %v", got, tt.want)
+			}
+			if last := stream[len(stream)-1]; last.Status != "end" {
+				t.Errorf("streamed %+v after the expected events", last)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceConfig describes one device of the decoy plant in config.json
+type DeviceConfig struct {
+	ID         string   `json:"id"`
+	Type       string   `json:"type"`
+	Protocols  []string `json:"protocols"`
+	IntervalMs int      `json:"interval_ms"`
+	Location   string   `json:"location"`
+}
+
+// Device is a virtual device with a stable identity and the state it last published
+type Device struct {
+	ID        string
+	Type      string
+	Protocols []string
+	Interval  time.Duration
+	Location  string
+
+	mu            sync.Mutex
+	metrics       []MetricSpec // from the catalogue entry of the type
+	signals       map[string]*signal
+	startup       time.Duration
+	state         string
+	stateSince    time.Time
+	alarms        map[int]*Alarm // by code
+	last          *OTData
+	lastPublished map[string]time.Time
+	published     map[string]int
+}
+
+// Fleet holds every device of the plant, created once at start-up
+type Fleet struct {
+	devices []*Device
+	byID    map[string]*Device
+}
+
+// defaultDeviceInterval is used when a device has no publish interval configured
+const defaultDeviceInterval = 5 * time.Second
+
+// newFleet builds the fleet from config. Without a configured fleet a small
+// random one is made up, like the generator used to do on every request.
+func newFleet(configs []DeviceConfig, models map[string]map[string]ModelConfig, types map[string]DeviceTypeSpec) (*Fleet, error) {
+	if len(configs) == 0 {
+		for i := 1; i <= 6; i++ {
+			deviceType := randomDeviceType(types)
+			configs = append(configs, DeviceConfig{
+				ID:        fmt.Sprintf("%s-%02d", deviceType, i),
+				Type:      deviceType,
+				Protocols: []string{"mqtt", "modbus", "coap"},
+			})
+		}
+	}
+
+	for deviceType := range models {
+		if _, ok := types[deviceType]; !ok {
+			return nil, fmt.Errorf("models configured for unknown device type %q", deviceType)
+		}
+	}
+
+	f := &Fleet{byID: make(map[string]*Device)}
+	for _, c := range configs {
+		if c.ID == "" {
+			return nil, fmt.Errorf("fleet device without id")
+		}
+		if _, exists := f.byID[c.ID]; exists {
+			return nil, fmt.Errorf("duplicate fleet device id %q", c.ID)
+		}
+		spec, ok := types[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("device %s has unknown type %q", c.ID, c.Type)
+		}
+
+		signals, err := modelsFor(c.Type, spec, models)
+		if err != nil {
+			return nil, err
+		}
+
+		interval := time.Duration(c.IntervalMs) * time.Millisecond
+		if interval <= 0 {
+			interval = defaultDeviceInterval
+		}
+		startup := time.Duration(spec.StartupS) * time.Second
+		if startup <= 0 {
+			startup = defaultStartup
+		}
+		d := &Device{
+			ID:            c.ID,
+			Type:          c.Type,
+			Protocols:     c.Protocols,
+			Interval:      interval,
+			Location:      c.Location,
+			metrics:       spec.Metrics,
+			signals:       signals,
+			startup:       startup,
+			alarms:        make(map[int]*Alarm),
+			lastPublished: make(map[string]time.Time),
+			published:     make(map[string]int),
+		}
+		f.devices = append(f.devices, d)
+		f.byID[d.ID] = d
+	}
+	return f, nil
+}
+
+// Devices returns the devices that publish over the given protocol
+func (f *Fleet) Devices(protocol string) []*Device {
+	var devices []*Device
+	for _, d := range f.devices {
+		if d.Uses(protocol) {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// Due returns the devices of a protocol whose publish interval has elapsed, skipping devices a scenario took offline
+func (f *Fleet) Due(protocol string, now time.Time) []*Device {
+	var due []*Device
+	for _, d := range f.Devices(protocol) {
+		if d.Offline(now) {
+			continue
+		}
+		d.mu.Lock()
+		last := d.lastPublished[protocol]
+		interval := d.Interval
+		d.mu.Unlock()
+		if now.Sub(last) >= current().scenarios.Interval(d.ID, now, interval) {
+			due = append(due, d)
+		}
+	}
+	return due
+}
+
+// Reports reports whether the device has a metric
+func (d *Device) Reports(metric string) bool {
+	for _, m := range d.metrics {
+		if m.Name == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// Uses reports whether the device publishes over the given protocol
+func (d *Device) Uses(protocol string) bool {
+	for _, p := range d.Protocols {
+		if strings.EqualFold(p, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sample produces the reading of the device at now, moves the device to its next state and keeps the reading
+func (d *Device) Sample(now time.Time) OTData {
+	// The models carry state between readings, so sampling is serialised per device
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.sample(now)
+}
+
+// sample is Sample with d.mu held
+func (d *Device) sample(now time.Time) OTData {
+	data := createOTData(d.ID, d.Type, d.metrics, d.signals, now)
+	data.Location = d.Location
+	d.updateState(&data, current().scenarios.Apply(&data))
+	d.last = &data
+	return data
+}
+
+// Reading returns the reading of the current interval of the device, sampling
+// a new one once the kept reading is an interval old. Every protocol publishes
+// the same values, and the models and the state advance once per interval
+// however many protocols the device uses.
+func (d *Device) Reading(now time.Time) OTData {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.last != nil && now.Sub(d.last.Timestamp) < current().scenarios.Interval(d.ID, now, d.Interval) {
+		return *d.last
+	}
+	return d.sample(now)
+}
+
+// SetInterval changes how often the device publishes
+func (d *Device) SetInterval(interval time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Interval = interval
+}
+
+// MarkPublished records that the device published over a protocol
+func (d *Device) MarkPublished(protocol string, at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastPublished[protocol] = at
+	d.published[protocol]++
+}
+
+// deviceView is the JSON representation of a device in the API
+type deviceView struct {
+	ID            string               `json:"id"`
+	Type          string               `json:"type"`
+	Protocols     []string             `json:"protocols"`
+	IntervalMs    int64                `json:"interval_ms"`
+	Location      string               `json:"location,omitempty"`
+	State         string               `json:"state"`
+	StateSince    *time.Time           `json:"state_since,omitempty"`
+	Alarms        []Alarm              `json:"alarms,omitempty"`
+	Last          *OTData              `json:"last,omitempty"`
+	LastPublished map[string]time.Time `json:"last_published"`
+	Published     map[string]int       `json:"published"`
+}
+
+func (d *Device) view() deviceView {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v := deviceView{
+		ID:            d.ID,
+		Type:          d.Type,
+		Protocols:     d.Protocols,
+		IntervalMs:    d.Interval.Milliseconds(),
+		Location:      d.Location,
+		State:         d.state,
+		Alarms:        d.alarmList(),
+		Last:          d.last,
+		LastPublished: make(map[string]time.Time, len(d.lastPublished)),
+		Published:     make(map[string]int, len(d.published)),
+	}
+	if !d.stateSince.IsZero() {
+		since := d.stateSince
+		v.StateSince = &since
+	}
+	for k, t := range d.lastPublished {
+		v.LastPublished[k] = t
+	}
+	for k, n := range d.published {
+		v.Published[k] = n
+	}
+	return v
+}
+
+// devicesHandler serves the fleet as JSON, /api/devices for all devices and /api/devices/{id} for one
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fleet := current().fleet
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/devices"), "/")
+	if id == "" {
+		views := make([]deviceView, 0, len(fleet.devices))
+		for _, d := range fleet.devices {
+			views = append(views, d.view())
+		}
+		json.NewEncoder(w).Encode(views)
+		return
+	}
+
+	d, ok := fleet.byID[id]
+	if !ok {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(d.view())
+}
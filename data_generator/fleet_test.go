@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadingOncePerInterval(t *testing.T) {
+	types, err := loadCatalogue(nil)
+	if err != nil {
+		t.Fatalf("loadCatalogue() = %v", err)
+	}
+	f, err := newFleet([]DeviceConfig{
+		{ID: "Meter-01", Type: "EnergyMeter", Protocols: []string{"mqtt", "modbus", "coap"}, IntervalMs: 2000},
+	}, nil, types)
+	if err != nil {
+		t.Fatalf("newFleet() = %v", err)
+	}
+	running.Store(&snapshot{config: &Config{}, fleet: f, scenarios: &ScenarioSchedule{}})
+	t.Cleanup(func() { running.Store(nil) })
+
+	d := f.byID["Meter-01"]
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := d.Reading(start)
+
+	// The other protocols of the same tick get the same reading, the energy counter does not move
+	for _, at := range []time.Duration{0, 500 * time.Millisecond, 1999 * time.Millisecond} {
+		if got := d.Reading(start.Add(at)); !reflect.DeepEqual(got, first) {
+			t.Errorf("Reading(+%v) = %+v, want the first reading %+v", at, got, first)
+		}
+	}
+
+	next := d.Reading(start.Add(2 * time.Second))
+	if !next.Timestamp.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("Reading(+2s) has timestamp %v, want a new reading at %v", next.Timestamp, start.Add(2*time.Second))
+	}
+	if got := d.Reading(start.Add(3 * time.Second)); !reflect.DeepEqual(got, next) {
+		t.Errorf("Reading(+3s) = %+v, want the reading of +2s %+v", got, next)
+	}
+}
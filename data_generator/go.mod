@@ -4,8 +4,11 @@ go 1.23.0
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.5.0
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/fxamacker/cbor/v2 v2.7.0
 	github.com/goburrow/modbus v0.1.0
 	github.com/plgd-dev/go-coap/v3 v3.3.6
+	google.golang.org/protobuf v1.36.6
 )
 
 require (
@@ -15,6 +18,7 @@ require (
 	github.com/pion/dtls/v3 v3.0.2 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/transport/v3 v3.0.7 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	go.uber.org/atomic v1.11.0 // indirect
 	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/exp v0.0.0-20240823005443-9b4947da3948 // indirect
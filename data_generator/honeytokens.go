@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Honeytoken kinds, what a token looks like and where it is published
+const (
+	tokenCredential = "credential" // username and password in the MQTT config topic of a device
+	tokenURL        = "url"        // web HMI link in the config topic and the Home Assistant device
+	tokenHostname   = "hostname"   // historian host in the config topic
+	tokenAPIKey     = "api_key"    // string in the holding registers of a Modbus device
+)
+
+// Honeytoken is a unique fake secret planted in the published data. Seeing
+// its value in traffic to a honeypot proves it was harvested and reused.
+type Honeytoken struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Device   string    `json:"device"`
+	Value    string    `json:"value"`
+	Username string    `json:"username,omitempty"` // credentials only, unique like the value
+	Created  time.Time `json:"created"`
+}
+
+// HoneytokenConfig enables the honeytokens and names the registry they are kept in
+type HoneytokenConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Registry string `json:"registry"` // JSON file of every token, read by attack_map to link reuse, honeytokens.json by default
+	Domain   string `json:"domain"`   // hostnames and URLs are made up under this domain, plant.local by default
+}
+
+// honeytokenSet holds the tokens of the fleet by device and kind
+type honeytokenSet struct {
+	byDevice map[string]map[string]*Honeytoken
+}
+
+// loadHoneytokens gives every device its tokens. Tokens already in the
+// registry are kept, so values harvested before a restart still link up;
+// new ones are added and the registry is written back.
+func loadHoneytokens(c HoneytokenConfig, f *Fleet) (*honeytokenSet, error) {
+	set := &honeytokenSet{byDevice: make(map[string]map[string]*Honeytoken)}
+	if !c.Enabled {
+		return set, nil
+	}
+
+	var tokens []*Honeytoken
+	data, err := os.ReadFile(c.Registry)
+	if err == nil {
+		if err := json.Unmarshal(data, &tokens); err != nil {
+			return nil, fmt.Errorf("could not parse honeytoken registry: %v", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read honeytoken registry: %v", err)
+	}
+	for _, t := range tokens {
+		if set.byDevice[t.Device] == nil {
+			set.byDevice[t.Device] = make(map[string]*Honeytoken)
+		}
+		set.byDevice[t.Device][t.Kind] = t
+	}
+
+	added := 0
+	for _, d := range f.devices {
+		for _, kind := range tokenKinds(d) {
+			if set.byDevice[d.ID] == nil {
+				set.byDevice[d.ID] = make(map[string]*Honeytoken)
+			}
+			if _, ok := set.byDevice[d.ID][kind]; ok {
+				continue
+			}
+			t := newHoneytoken(kind, d, c.Domain)
+			set.byDevice[d.ID][kind] = t
+			tokens = append(tokens, t)
+			added++
+		}
+	}
+	if added == 0 {
+		return set, nil
+	}
+
+	// Tokens of devices that left the fleet stay in the registry, they may still turn up
+	data, err = json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(c.Registry, data, 0644); err != nil {
+		return nil, fmt.Errorf("could not write honeytoken registry: %v", err)
+	}
+	log.Printf("Planted %d new honeytokens, registry in %s", added, c.Registry)
+	return set, nil
+}
+
+// plantHoneytokens loads the honeytokens for a running generator. A registry
+// that cannot be read or written turns them off instead of stopping the
+// generator, tokens nobody keeps track of would be worthless anyway.
+func plantHoneytokens(c HoneytokenConfig, f *Fleet) *honeytokenSet {
+	set, err := loadHoneytokens(c, f)
+	if err != nil {
+		log.Printf("Honeytokens disabled: %v", err)
+		return &honeytokenSet{}
+	}
+	return set
+}
+
+// tokenKinds returns the kinds of token a device carries, by the protocols it publishes over
+func tokenKinds(d *Device) []string {
+	var kinds []string
+	if d.Uses("mqtt") {
+		kinds = append(kinds, tokenCredential, tokenURL, tokenHostname)
+	}
+	if d.Uses("modbus") {
+		kinds = append(kinds, tokenAPIKey)
+	}
+	return kinds
+}
+
+// newHoneytoken makes up a token of a kind for a device. Values come from
+// crypto/rand rather than the seeded generator, so no two deployments share them.
+func newHoneytoken(kind string, d *Device, domain string) *Honeytoken {
+	name := strings.ToLower(d.ID)
+	t := &Honeytoken{ID: "ht-" + randomHex(4), Kind: kind, Device: d.ID, Created: time.Now()}
+	switch kind {
+	case tokenCredential:
+		t.Username = fmt.Sprintf("svc_%s_%s", strings.ReplaceAll(name, "-", ""), randomHex(2))
+		t.Value = randomHex(8)
+	case tokenURL:
+		t.Value = fmt.Sprintf("https://hmi-%s.%s/webhmi/%s?session=%s", randomHex(3), domain, name, randomHex(8))
+	case tokenHostname:
+		t.Value = fmt.Sprintf("historian-%s.%s", randomHex(3), domain)
+	case tokenAPIKey:
+		t.Value = "ak_live_" + randomHex(12)
+	}
+	return t
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// token returns the token of a kind of a device, nil when it has none
+func (s *honeytokenSet) token(device, kind string) *Honeytoken {
+	return s.byDevice[device][kind]
+}
+
+// deviceConfig is the retained config topic of a device, a lure with the credential, hostname and URL tokens
+func (s *honeytokenSet) deviceConfig(device *Device) ([]byte, bool) {
+	credential, host, url := s.token(device.ID, tokenCredential), s.token(device.ID, tokenHostname), s.token(device.ID, tokenURL)
+	if credential == nil || host == nil || url == nil {
+		return nil, false
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"device_id": device.ID,
+		"location":  device.Location,
+		"web_hmi":   url.Value,
+		"historian": map[string]interface{}{
+			"host":     host.Value,
+			"port":     5432,
+			"username": credential.Username,
+			"password": credential.Value,
+		},
+	})
+	return payload, true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestTokenKinds(t *testing.T) {
+	tests := []struct {
+		protocols []string
+		want      []string
+	}{
+		{[]string{"mqtt"}, []string{tokenCredential, tokenURL, tokenHostname}},
+		{[]string{"modbus"}, []string{tokenAPIKey}},
+		{[]string{"MQTT", "modbus", "coap"}, []string{tokenCredential, tokenURL, tokenHostname, tokenAPIKey}},
+		{[]string{"coap", "sparkplug"}, nil},
+	}
+	for _, tt := range tests {
+		if got := tokenKinds(&Device{Protocols: tt.protocols}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenKinds(%v) = %v, want %v", tt.protocols, got, tt.want)
+		}
+	}
+}
+
+func TestNewHoneytoken(t *testing.T) {
+	device := &Device{ID: "PLC-01"}
+	tests := []struct {
+		kind     string
+		value    string
+		username string
+	}{
+		{tokenCredential, `^[0-9a-f]{16}$`, `^svc_plc01_[0-9a-f]{4}$`},
+		{tokenURL, `^https://hmi-[0-9a-f]{6}\.plant\.example/webhmi/plc-01\?session=[0-9a-f]{16}$`, `^$`},
+		{tokenHostname, `^historian-[0-9a-f]{6}\.plant\.example$`, `^$`},
+		{tokenAPIKey, `^ak_live_[0-9a-f]{24}$`, `^$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			token := newHoneytoken(tt.kind, device, "plant.example")
+			if token.Kind != tt.kind || token.Device != device.ID || !regexp.MustCompile(`^ht-[0-9a-f]{8}$`).MatchString(token.ID) {
+				t.Errorf("newHoneytoken() = %+v", token)
+			}
+			if !regexp.MustCompile(tt.value).MatchString(token.Value) {
+				t.Errorf("value %q does not match %s", token.Value, tt.value)
+			}
+			if !regexp.MustCompile(tt.username).MatchString(token.Username) {
+				t.Errorf("username %q does not match %s", token.Username, tt.username)
+			}
+			if other := newHoneytoken(tt.kind, device, "plant.example"); other.Value == token.Value {
+				t.Errorf("two tokens share the value %q", token.Value)
+			}
+		})
+	}
+}
+
+func testFleet(devices ...*Device) *Fleet {
+	f := &Fleet{byID: make(map[string]*Device)}
+	for _, d := range devices {
+		f.devices = append(f.devices, d)
+		f.byID[d.ID] = d
+	}
+	return f
+}
+
+func TestLoadHoneytokens(t *testing.T) {
+	fleet := testFleet(
+		&Device{ID: "PLC-01", Protocols: []string{"mqtt", "modbus"}},
+		&Device{ID: "SNS-01", Protocols: []string{"coap"}},
+	)
+	kept := &Honeytoken{ID: "ht-00000001", Kind: tokenAPIKey, Device: "PLC-01", Value: "ak_live_kept"}
+	gone := &Honeytoken{ID: "ht-00000002", Kind: tokenAPIKey, Device: "OLD-01", Value: "ak_live_gone"}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		registry []*Honeytoken // written before loading, nil for no registry
+		raw      string        // written instead when set
+		want     int           // tokens in the registry after loading, -1 when it is not written
+		wantErr  bool
+	}{
+		{name: "disabled", enabled: false, want: -1},
+		{name: "new registry", enabled: true, want: 4},
+		{name: "existing tokens are kept", enabled: true, registry: []*Honeytoken{kept, gone}, want: 5},
+		{name: "corrupt registry", enabled: true, raw: "{", want: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "honeytokens.json")
+			if tt.registry != nil {
+				data, _ := json.Marshal(tt.registry)
+				os.WriteFile(path, data, 0644)
+			}
+			if tt.raw != "" {
+				os.WriteFile(path, []byte(tt.raw), 0644)
+			}
+
+			set, err := loadHoneytokens(HoneytokenConfig{Enabled: tt.enabled, Registry: path, Domain: "plant.example"}, fleet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadHoneytokens() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var written []*Honeytoken
+			data, err := os.ReadFile(path)
+			if err == nil {
+				json.Unmarshal(data, &written)
+			}
+			if (tt.want < 0 && err == nil) || (tt.want >= 0 && len(written) != tt.want) {
+				t.Errorf("registry holds %d tokens (%v), want %d", len(written), err, tt.want)
+			}
+			if tt.enabled && len(set.byDevice["PLC-01"]) != 4 {
+				t.Errorf("PLC-01 has %d tokens, want 4", len(set.byDevice["PLC-01"]))
+			}
+			if len(set.byDevice["SNS-01"]) != 0 {
+				t.Errorf("SNS-01 has tokens, CoAP devices carry none")
+			}
+			if tt.registry != nil && set.token("PLC-01", tokenAPIKey).Value != kept.Value {
+				t.Errorf("api key = %q, want the one from the registry", set.token("PLC-01", tokenAPIKey).Value)
+			}
+		})
+	}
+}
+
+func TestPlantHoneytokensUnwritableRegistry(t *testing.T) {
+	fleet := testFleet(&Device{ID: "PLC-01", Protocols: []string{"mqtt"}})
+	c := HoneytokenConfig{Enabled: true, Registry: filepath.Join(t.TempDir(), "missing", "honeytokens.json")}
+
+	set := plantHoneytokens(c, fleet)
+	if set == nil || set.token("PLC-01", tokenCredential) != nil {
+		t.Errorf("plantHoneytokens() = %+v, want an empty set", set)
+	}
+	if _, ok := set.deviceConfig(fleet.byID["PLC-01"]); ok {
+		t.Error("deviceConfig() published tokens nobody keeps track of")
+	}
+}
+
+func TestDeviceConfig(t *testing.T) {
+	device := &Device{ID: "PLC-01", Location: "Hall 1"}
+	full := map[string]*Honeytoken{
+		tokenCredential: {Username: "svc_plc01_ab12", Value: "secret"},
+		tokenHostname:   {Value: "historian-1.plant.example"},
+		tokenURL:        {Value: "https://hmi-1.plant.example/webhmi/plc-01"},
+	}
+	tests := []struct {
+		name   string
+		tokens map[string]*Honeytoken
+		want   string
+	}{
+		{
+			"every token",
+			full,
+			`{"device_id":"PLC-01","historian":{"host":"historian-1.plant.example","password":"secret","port":5432,"username":"svc_plc01_ab12"},"location":"Hall 1","web_hmi":"https://hmi-1.plant.example/webhmi/plc-01"}`,
+		},
+		{"missing url", map[string]*Honeytoken{tokenCredential: full[tokenCredential], tokenHostname: full[tokenHostname]}, ""},
+		{"no tokens", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := &honeytokenSet{byDevice: map[string]map[string]*Honeytoken{"PLC-01": tt.tokens}}
+			payload, ok := set.deviceConfig(device)
+			if ok != (tt.want != "") || string(payload) != tt.want {
+				t.Errorf("deviceConfig() = %s, %v, want %s", payload, ok, tt.want)
+			}
+		})
+	}
+}
@@ -3,25 +3,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"math"
-	"math/rand"
 	"net/http"
 	"os"
+	ossignal "os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
-
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/goburrow/modbus"
-	"github.com/plgd-dev/go-coap/v3/message/pool"
-	"github.com/plgd-dev/go-coap/v3/udp"
 )
 
 var (
-	enableMQTT   = flag.Bool("mqtt", false, "Enable MQTT service")
-	enableModbus = flag.Bool("modbus", false, "Enable Modbus service")
-	enableCoAP   = flag.Bool("coap", false, "Enable CoAP service")
+	enableMQTT   = flag.Bool("mqtt", false, "Enable MQTT service, generated from boot")
+	enableModbus = flag.Bool("modbus", false, "Enable Modbus service, generated from boot")
+	enableCoAP   = flag.Bool("coap", false, "Enable CoAP service, generated from boot")
 )
 
 // Config structure holds the configuration for the MQTT and web servers
@@ -30,73 +28,193 @@ type Config struct {
 		Port int `json:"port"`
 	} `json:"web"`
 	MQTT struct {
-		Address string `json:"address"`
-		Port    int    `json:"port"`
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Address        string `json:"address"`
+		Port           int    `json:"port"`
+		Username       string `json:"username"`
+		Password       string `json:"password"`
+		ClientIDPrefix string `json:"client_id_prefix"` // every device connects as <prefix><device id>
+		KeepAliveS     int    `json:"keepalive_s"`
+		TLS            struct {
+			Enabled    bool   `json:"enabled"`
+			CAFile     string `json:"ca_file"`
+			CertFile   string `json:"cert_file"`
+			KeyFile    string `json:"key_file"`
+			SkipVerify bool   `json:"skip_verify"`
+		} `json:"tls"`
+		QoS struct {
+			Data   byte `json:"data"`   // ot/device/<type>/<id>
+			Values byte `json:"values"` // retained ot/device/<type>/<id>/<metric> and /state
+			Status byte `json:"status"` // retained online/offline and Last Will on ot/device/<type>/<id>/status
+		} `json:"qos"`
+		Discovery struct {
+			HomeAssistant       bool   `json:"home_assistant"`        // retained Home Assistant discovery config for every device
+			HomeAssistantPrefix string `json:"home_assistant_prefix"` // discovery prefix, homeassistant by default
+			Homie               bool   `json:"homie"`                 // every device also as a Homie 4 device under homie/
+		} `json:"discovery"`
 	} `json:"mqtt"`
 	CoAP struct {
-		Address string `json:"address"`
-		Port    int    `json:"port"`
+		Address   string `json:"address"`
+		Port      int    `json:"port"`
+		Method    string `json:"method"`     // PUT or POST
+		Format    string `json:"format"`     // json, cbor, senml+json or senml+cbor
+		TimeoutMs int    `json:"timeout_ms"` // per request timeout
 	} `json:"coap"`
+	Sparkplug struct {
+		GroupID    string `json:"group_id"`
+		EdgeNodeID string `json:"edge_node_id"`
+	} `json:"sparkplug"` // published over the MQTT broker above
 	ModBus struct {
-		Address string `json:"address"`
-		Port    int    `json:"port"`
+		Address     string `json:"address"`
+		Port        int    `json:"port"`
+		RegisterMap string `json:"register_map"` // per-device register layout, shared with the Modbus honeypot
 	} `json:"modbus"`
+	Fleet       []DeviceConfig                    `json:"fleet"`
+	DeviceTypes map[string]DeviceTypeSpec         `json:"device_types"` // added to or replacing the built-in catalogue
+	Models      map[string]map[string]ModelConfig `json:"models"`       // device type -> metric -> signal model
+
+	ScenarioFile string           `json:"scenario_file"`
+	Replay       ReplayConfig     `json:"replay"`      // recorded values replayed instead of the models
+	Honeytokens  HoneytokenConfig `json:"honeytokens"` // unique fake secrets in the published data
+	Alarms       struct {
+		AutoAckS int `json:"auto_ack_s"` // acknowledge alarms left unacknowledged this long, 0 never does
+	} `json:"alarms"`
+	Scheduler struct {
+		Services   []string       `json:"services"`    // generated from boot, besides the ones enabled by flags
+		IntervalMs map[string]int `json:"interval_ms"` // per service, defaults to one second
+	} `json:"scheduler"`
 }
 
 // OTData represents the structure of the data we send
 type OTData struct {
-	Timestamp        time.Time `json:"timestamp"`
-	DeviceID         string    `json:"device_id"`
-	Temperature      *float64  `json:"temperature,omitempty"`
-	Pressure         *float64  `json:"pressure,omitempty"`
-	Humidity         *float64  `json:"humidity,omitempty"`
-	Vibration        *float64  `json:"vibration,omitempty"`
-	PowerConsumption *float64  `json:"power_consumption,omitempty"`
-	FlowRate         *float64  `json:"flow_rate,omitempty"`
-	Status           string    `json:"status"`
+	Timestamp  time.Time          `json:"timestamp"`
+	DeviceID   string             `json:"device_id"`
+	DeviceType string             `json:"device_type"`
+	Location   string             `json:"location,omitempty"`
+	Metrics    map[string]float64 `json:"metrics"`              // the metrics of the device type, by name
+	Status     string             `json:"status"`               // the state of the device, see state.go
+	AlarmCode  int                `json:"alarm_code,omitempty"` // lowest code of the active alarms
+	Alarms     []Alarm            `json:"alarms,omitempty"`     // active or unacknowledged alarms
 }
 
-var config Config
-
 func main() {
 	flag.Parse()
 
 	// Load configuration from config.json
-	if err := loadConfig(); err != nil {
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
 		fmt.Println("Error loading config:", err)
 		return
 	}
+	s := &snapshot{config: &cfg, honeytokens: &honeytokenSet{}, scenarios: &ScenarioSchedule{}}
+
+	// An attack run plays its script against the honeypots and exits
+	if *attackFile != "" {
+		running.Store(s)
+		if err := runAttack(*attackFile); err != nil {
+			fmt.Println("Error in attack run:", err)
+		}
+		return
+	}
+
+	// A dry run runs on a simulated clock, scenarios count from its start
+	start := time.Now()
+	if *dryRunFormat != "" {
+		if start, err = dryRunStart(); err != nil {
+			fmt.Println("Error starting dry run:", err)
+			return
+		}
+	}
+	seedRandom()
+
+	// Build the device catalogue and create the virtual devices once, they keep their identity until the fleet is reconfigured
+	if s.catalogue, err = loadCatalogue(cfg.DeviceTypes); err != nil {
+		fmt.Println("Error loading device catalogue:", err)
+		return
+	}
+	if s.fleet, err = newFleet(cfg.Fleet, cfg.Models, s.catalogue); err != nil {
+		fmt.Println("Error creating device fleet:", err)
+		return
+	}
+
+	// Plant the honeytokens before the register layout, API keys take Modbus registers.
+	// A dry run publishes nothing, so it leaves the registry alone.
+	if *dryRunFormat == "" {
+		s.honeytokens = plantHoneytokens(cfg.Honeytokens, s.fleet)
+	}
+
+	// Lay out the Modbus registers of every device
+	if s.registerMaps, err = loadRegisterMaps(cfg.ModBus.RegisterMap, s.fleet, s.honeytokens); err != nil {
+		fmt.Println("Error loading register map:", err)
+		return
+	}
+
+	// Schedule the fault and anomaly scenarios, relative start times count from now
+	if cfg.ScenarioFile != "" {
+		if s.scenarios, err = loadScenarios(cfg.ScenarioFile, s.fleet, start); err != nil {
+			fmt.Println("Error loading scenarios:", err)
+			return
+		}
+	}
+
+	// Replay recorded values from the start, a dry run replays on its simulated clock
+	if s.replay, err = loadReplay(cfg.Replay, s.fleet, start); err != nil {
+		fmt.Println("Error loading replay:", err)
+		return
+	}
+	running.Store(s)
+
+	// A dry run writes the readings and exits, nothing is sent to the honeypots
+	if *dryRunFormat != "" {
+		if err := dryRun(start); err != nil {
+			fmt.Println("Error in dry run:", err)
+		}
+		return
+	}
+
+	// Generate for the enabled services from boot, without waiting for someone to open the page
+	for _, service := range enabledServices(&cfg) {
+		scheduler.Start(service, serviceInterval(service))
+	}
+
+	// Apply changes to the config file without a restart
+	watchConfig(*configPath)
+
+	// Close the long-lived publisher connections on shutdown
+	go func() {
+		stop := make(chan os.Signal, 1)
+		ossignal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		closePublishers()
+		os.Exit(0)
+	}()
 
 	// Convert flag status into a JSON object for the HTML page to read
 	// These values will pre-check the checkboxes in the HTML.
 	http.HandleFunc("/", serveHTML)
 	http.HandleFunc("/generate", generateData)
+	http.HandleFunc("/api/devices", devicesHandler)
+	http.HandleFunc("/api/devices/", devicesHandler)
+	registerAPI(http.DefaultServeMux)
 
 	// Start the web server
-	webAddress := fmt.Sprintf(":%d", config.Web.Port)
+	webAddress := fmt.Sprintf(":%d", cfg.Web.Port)
 	fmt.Printf("Server started at http://%s\n", webAddress)
 	http.ListenAndServe(webAddress, nil)
 }
 
-// loadConfig reads the configuration from the config.json file
-func loadConfig() error {
-	data, err := os.ReadFile("config.json")
-	if err != nil {
-		return fmt.Errorf("could not read config file: %v", err)
+// serveHTML serves the static HTML file
+func serveHTML(w http.ResponseWriter, r *http.Request) {
+	// One checkbox per registered publisher, pre-checked when enabled from boot
+	enabled := make(map[string]bool)
+	for _, service := range enabledServices(current().config) {
+		enabled[service] = true
 	}
-
-	err = json.Unmarshal(data, &config)
-	if err != nil {
-		return fmt.Errorf("could not parse config file: %v", err)
+	preselected, _ := json.Marshal(enabled)
+	var checkboxes strings.Builder
+	for _, p := range publishers {
+		fmt.Fprintf(&checkboxes, "            <li><input type=\"checkbox\" name=\"service\" value=\"%s\" onchange=\"onCheckboxChange()\"> %s</li>\n", p.name, p.displayName)
 	}
 
-	return nil
-}
-
-// serveHTML serves the static HTML file
-func serveHTML(w http.ResponseWriter, r *http.Request) {
 	html := fmt.Sprintf(`<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -105,11 +223,7 @@ func serveHTML(w http.ResponseWriter, r *http.Request) {
     <title>Service Selection</title>
     <script>
         // Set the initial states based on command-line flags
-        const preselectedServices = {
-            mqtt: %t,
-            modbus: %t,
-            coap: %t
-        };
+        const preselectedServices = %s;
 
         window.onload = function() {
             const savedServices = JSON.parse(localStorage.getItem('selectedServices')) || [];
@@ -122,9 +236,15 @@ func serveHTML(w http.ResponseWriter, r *http.Request) {
             if (document.querySelectorAll('input[name="service"]:checked').length > 0) {
                 startSendingData();
             }
+            new EventSource("/api/events").onmessage = message => showEvent(JSON.parse(message.data));
         };
 
+        let intervalId = null;
+        let pending = null;
+
         function startSendingData() {
+            // A change of selection replaces the running interval rather than adding one
+            clearInterval(intervalId);
             const selectedServices = [];
             document.querySelectorAll('input[name="service"]:checked').forEach(checkbox => {
                 selectedServices.push(checkbox.value);
@@ -132,16 +252,28 @@ func serveHTML(w http.ResponseWriter, r *http.Request) {
 
             if (selectedServices.length > 0) {
                 intervalId = setInterval(() => {
+                    // Skip a tick while the previous request still runs instead of piling them up
+                    if (pending) {
+                        return;
+                    }
+                    pending = new AbortController();
                     fetch("/generate", {
                         method: "POST",
                         headers: {
                             "Content-Type": "application/json"
                         },
-                        body: JSON.stringify({ services: selectedServices })
+                        body: JSON.stringify({ services: selectedServices }),
+                        signal: pending.signal
                     })
-                    .then(response => response.text())
+                    .then(response => response.json())
                     .then(data => {
-                        document.getElementById("output").textContent = data;
+                        document.getElementById("output").textContent = data.services.map(result =>
+                            (result.name || result.service) + ": " + result.status + ", " + result.sent + " sent in " + result.duration_ms + " ms" +
+                            (result.error ? " (" + result.error + ")" : "")).join("\n");
+                    })
+                    .catch(() => {})
+                    .finally(() => {
+                        pending = null;
                     });
                 }, 1000);
             }
@@ -149,6 +281,75 @@ func serveHTML(w http.ResponseWriter, r *http.Request) {
 
         function stopSendingData() {
             clearInterval(intervalId);
+            // Cancels the round on the server too
+            if (pending) {
+                pending.abort();
+            }
+        }
+
+        // The live view shows the last reading of every device with a sparkline per metric
+        const historyLength = 60;
+        const rows = {};
+
+        function sparkline(values) {
+            const width = 80, height = 18;
+            const min = Math.min(...values), max = Math.max(...values);
+            const span = max - min || 1;
+            const points = values.map((v, i) =>
+                (i * width / Math.max(values.length - 1, 1)).toFixed(1) + "," + (height - 1 - (v - min) / span * (height - 2)).toFixed(1));
+            return '<svg width="' + width + '" height="' + height + '"><polyline fill="none" stroke="steelblue" points="' + points.join(" ") + '"/></svg>';
+        }
+
+        function deviceRow(device) {
+            if (!rows[device]) {
+                const tr = document.createElement("tr");
+                tr.dataset.device = device;
+                tr.innerHTML = "<td></td><td></td><td></td><td></td><td></td><td></td><td></td>";
+                // Keep the table sorted by device
+                const tbody = document.querySelector("#devices tbody");
+                const next = Array.from(tbody.children).find(row => row.dataset.device > device);
+                tbody.insertBefore(tr, next || null);
+                rows[device] = { tr: tr, history: {} };
+            }
+            return rows[device];
+        }
+
+        function showEvent(event) {
+            const time = new Date(event.time).toLocaleTimeString();
+            if (event.error) {
+                const errors = document.getElementById("errors");
+                const li = document.createElement("li");
+                li.textContent = time + " " + event.service + (event.device ? " " + event.device : "") + ": " + event.error;
+                errors.prepend(li);
+                while (errors.children.length > 20) {
+                    errors.lastChild.remove();
+                }
+            }
+            if (!event.device) {
+                return;
+            }
+
+            const row = deviceRow(event.device);
+            const metrics = event.metrics || {};
+            const names = Object.keys(metrics).sort();
+            names.forEach(name => {
+                const history = row.history[name] = row.history[name] || [];
+                history.push(metrics[name]);
+                if (history.length > historyLength) {
+                    history.shift();
+                }
+            });
+
+            const cells = row.tr.children;
+            cells[0].textContent = event.device;
+            cells[1].textContent = event.device_type;
+            cells[2].textContent = event.status + (event.alarm_code ? " (" + event.alarm_code + ")" : "");
+            cells[2].className = "state-" + (event.status || "").toLowerCase();
+            cells[3].textContent = event.service;
+            cells[4].textContent = event.target || "";
+            cells[5].innerHTML = names.map(name =>
+                '<div class="metric"><span>' + name + " " + metrics[name] + "</span>" + sparkline(row.history[name]) + "</div>").join("");
+            cells[6].textContent = time + (event.error ? " (failed)" : "");
         }
 
         function onCheckboxChange() {
@@ -165,25 +366,42 @@ func serveHTML(w http.ResponseWriter, r *http.Request) {
             }
         }
     </script>
+    <style>
+        table { border-collapse: collapse; }
+        th, td { border-bottom: 1px solid #ddd; padding: 4px 8px; text-align: left; vertical-align: top; }
+        .metric { display: flex; justify-content: space-between; gap: 8px; font-family: monospace; }
+        .state-fault { color: #c00; font-weight: bold; }
+        .state-maintenance { color: #c60; }
+        .state-idle, .state-offline { color: #888; }
+        .state-starting { color: #06c; }
+    </style>
 </head>
 <body>
     <h2>Select Services to Generate Fake Data</h2>
     <form onsubmit="event.preventDefault();">
         <ul>
-            <li><input type="checkbox" name="service" value="mqtt" onchange="onCheckboxChange()"> MQTT</li>
-            <li><input type="checkbox" name="service" value="modbus" onchange="onCheckboxChange()"> Modbus</li>
-            <li><input type="checkbox" name="service" value="coap" onchange="onCheckboxChange()"> CoAP</li>
-        </ul>
+%s        </ul>
     </form>
     <pre id="output"></pre>
+    <h2>Live Data</h2>
+    <table id="devices">
+        <thead>
+            <tr><th>Device</th><th>Type</th><th>State</th><th>Service</th><th>Target</th><th>Values</th><th>Last published</th></tr>
+        </thead>
+        <tbody></tbody>
+    </table>
+    <h3>Errors</h3>
+    <ul id="errors"></ul>
 </body>
-</html>`, *enableMQTT, *enableModbus, *enableCoAP)
+</html>`, preselected, checkboxes.String())
 
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(html))
 }
 
-// generateData handles the data generation based on selected services
+// generateData handles the data generation based on selected services. The
+// services run concurrently and stop when the request is cancelled, the
+// response summarises what each one sent.
 func generateData(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -199,210 +417,119 @@ func generateData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Simulate sending fake data over selected protocols
-	for _, service := range selected.Services {
-		switch service {
-		case "mqtt":
-			generateMQTTData()
-		case "modbus":
-			generateModbusData()
-		case "coap":
-			generateCoAPData()
-		default:
-			fmt.Sprintf("Unknown service: %s\n", service)
-		}
-
-		// Simulate a delay for each service
-		time.Sleep(500 * time.Millisecond)
-	}
-
-	w.Header().Set("Content-Type", "text/plain")
-}
-
-// generateMQTTData simulates the data generation and sending to an MQTT broker
-func generateMQTTData() string {
-	broker := fmt.Sprintf("tcp://%s:%d", config.MQTT.Address, config.MQTT.Port)
-	opts := mqtt.NewClientOptions().AddBroker(broker)
-	opts.SetUsername(config.MQTT.Username)
-	opts.SetPassword(config.MQTT.Password)
-	opts.SetClientID("go_mqtt_client")
-
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Sprintf("Failed to connect to MQTT broker on %s:%d: %v\n", config.MQTT.Address, config.MQTT.Port, token.Error())
+	results := make([]serviceResult, len(selected.Services))
+	var wg sync.WaitGroup
+	for i, service := range selected.Services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runService(r.Context(), service)
+		}()
 	}
-	defer client.Disconnect(250)
-
-	// Simulate data generation and publishing on each topic
-	for i := 1; i <= rand.Intn(10)+1; i++ { // Randomize the number of devices (1-10)
-		deviceType := randomDeviceType()                  // Randomly choose a device type
-		deviceID := fmt.Sprintf("%s-%02d", deviceType, i) // Generate device IDs like "TempHumidity-01"
+	wg.Wait()
 
-		// Create a unique topic based on the device type and device ID
-		topic := fmt.Sprintf("ot/device/%s/%s", deviceType, deviceID)
-
-		data := createOTData(deviceID, deviceType)
-
-		payload, err := json.Marshal(data)
-		if err != nil {
-			return fmt.Sprintf("Failed to generate data for device %s: %v\n", deviceID, err)
+	// Only report success when at least one service delivered its data or was already busy delivering it
+	failed := 0
+	for _, result := range results {
+		if result.Status == statusFailed || result.Status == statusUnknown {
+			failed++
 		}
-
-		token := client.Publish(topic, 0, false, payload)
-		token.Wait()
-		time.Sleep(500 * time.Millisecond) // Simulate delay between messages
 	}
-
-	return "Sending OT MQTT data\n"
-}
-
-func generateModbusData() string {
-	handler := modbus.NewTCPClientHandler(fmt.Sprintf("%s:%d", config.ModBus.Address, config.ModBus.Port))
-	handler.Timeout = 1 * time.Second
-	handler.SlaveId = 1
-	handler.Logger = log.New(os.Stdout, "modbus: ", log.LstdFlags)
-
-	client := modbus.NewClient(handler)
-	err := handler.Connect()
-	if err != nil {
-		return fmt.Sprintf("Failed to connect to Modbus server on %s:%d: %v\n", config.ModBus.Address, config.ModBus.Port, err)
+	status := http.StatusOK
+	if len(results) > 0 && failed == len(results) {
+		status = http.StatusBadGateway
 	}
-	defer handler.Close()
-
-	// Simulate data generation and writing to Modbus registers
-	for i := 1; i <= rand.Intn(10)+1; i++ { // Randomize the number of devices (1-10)
-		deviceType := randomDeviceType()                  // Randomly choose a device type
-		deviceID := fmt.Sprintf("%s-%02d", deviceType, i) // Generate device IDs like "TempHumidity-01"
-
-		data := createOTData(deviceID, deviceType)
-
-		// Convert data to Modbus register values
-		registers := []uint16{
-			uint16(data.Timestamp.Unix() & 0xFFFF),
-			uint16((data.Timestamp.Unix() >> 16) & 0xFFFF),
-		}
+	writeJSON(w, status, map[string][]serviceResult{"services": results})
+}
 
-		if data.Temperature != nil {
-			registers = append(registers, uint16(*data.Temperature*100))
-		}
-		if data.Pressure != nil {
-			registers = append(registers, uint16(*data.Pressure*100))
-		}
-		if data.Humidity != nil {
-			registers = append(registers, uint16(*data.Humidity*100))
-		}
-		if data.Vibration != nil {
-			registers = append(registers, uint16(*data.Vibration*100))
-		}
-		if data.PowerConsumption != nil {
-			registers = append(registers, uint16(*data.PowerConsumption*100))
-		}
-		if data.FlowRate != nil {
-			registers = append(registers, uint16(*data.FlowRate*100))
-		}
+// Outcomes of a round of a service
+const (
+	statusSent      = "sent"
+	statusFailed    = "failed"
+	statusBusy      = "busy"      // the previous round of the service still runs
+	statusCancelled = "cancelled" // the request or scheduler stopped the round
+	statusUnknown   = "unknown"
+)
 
-		// Write data to Modbus registers
-		// Convert []uint16 to []byte
-		registerBytes := make([]byte, len(registers)*2)
-		for i, reg := range registers {
-			registerBytes[i*2] = byte(reg >> 8)
-			registerBytes[i*2+1] = byte(reg & 0xFF)
-		}
-		_, err := client.WriteMultipleRegisters(0, uint16(len(registerBytes)/2), registerBytes)
-		if err != nil {
-			return fmt.Sprintf("Failed to write data to Modbus for device %s: %v\n", deviceID, err)
-		}
+// serviceResult is what one round of a service did
+type serviceResult struct {
+	Service    string `json:"service"`
+	Name       string `json:"name,omitempty"`
+	Status     string `json:"status"`
+	Sent       int    `json:"sent"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
 
-		time.Sleep(500 * time.Millisecond) // Simulate delay between messages
+// String describes the result as a log line
+func (r serviceResult) String() string {
+	switch r.Status {
+	case statusUnknown:
+		return fmt.Sprintf("Unknown service: %s", r.Service)
+	case statusSent:
+		return fmt.Sprintf("Sending OT %s data", r.Name)
 	}
-
-	return "Sending OT Modbus data\n"
+	return fmt.Sprintf("%s: %s", r.Name, r.Error)
 }
 
-// generateCoAPData simulates CoAP data generation (dummy)
-func generateCoAPData() {
-	coapAddress := fmt.Sprintf("%s:%d", config.CoAP.Address, config.CoAP.Port)
-	sync := make(chan bool)
-	co, err := udp.Dial(coapAddress)
-	if err != nil {
-		log.Fatalf("Error dialing: %v", err)
+// runService generates one round of data for a service and records the outcome
+// in the service status, a busy service is skipped rather than waited for
+func runService(ctx context.Context, service string) serviceResult {
+	result := serviceResult{Service: service, Status: statusUnknown}
+	entry, ok := publishersByID[service]
+	if !ok {
+		result.Error = "unknown service"
+		return result
 	}
-	num := 0
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	obs, err := co.Observe(ctx, "/some/path", func(req *pool.Message) {
-		log.Printf("Got %+v\n", req)
-		num++
-		if num >= 10 {
-			sync <- true
+	result.Name = entry.displayName
+
+	start := time.Now()
+	sent, err := entry.publishRound(ctx)
+	result.Sent, result.DurationMs = sent, time.Since(start).Milliseconds()
+	switch {
+	case errors.Is(err, errRoundBusy):
+		result.Status = statusBusy
+		result.Error = err.Error()
+		return result
+	case err != nil && ctx.Err() != nil:
+		// What was sent before the cancel still counts, a round that sent
+		// nothing says nothing about the service and leaves its status alone
+		if sent > 0 {
+			recordServiceResult(service, sent, nil)
 		}
-	})
+		result.Status = statusCancelled
+		result.Error = err.Error()
+		return result
+	}
+
+	recordServiceResult(service, sent, err)
+	result.Status = statusSent
 	if err != nil {
-		log.Printf("Unexpected error '%v'", err)
+		result.Status = statusFailed
+		result.Error = err.Error()
 	}
-	<-sync
-	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	obs.Cancel(ctx)
+	return result
 }
 
-// randomDeviceType randomly selects a device type that sends different data
-func randomDeviceType() string {
-	deviceTypes := []string{"TempHumidity", "Flow", "Vibration", "Power"}
-	return deviceTypes[rand.Intn(len(deviceTypes))]
+// randomDeviceType randomly selects a device type of the catalogue
+func randomDeviceType(types map[string]DeviceTypeSpec) string {
+	names := deviceTypeNames(types)
+	return names[rng.Intn(len(names))]
 }
 
-// createOTData generates data for a specific device type
-func createOTData(deviceID, deviceType string) OTData {
-	status := "Operational"
+// createOTData samples every metric of a device type, in catalogue order so correlated metrics follow their source
+func createOTData(deviceID, deviceType string, metrics []MetricSpec, signals map[string]*signal, now time.Time) OTData {
+	sampler := newMetricSampler(deviceID, signals, now)
 
 	data := OTData{
-		Timestamp: time.Now(),
-		DeviceID:  deviceID,
-		Status:    status,
+		Timestamp:  now,
+		DeviceID:   deviceID,
+		DeviceType: deviceType,
+		Metrics:    make(map[string]float64, len(metrics)),
 	}
-
-	// Apply device-specific data
-	switch deviceType {
-	case "TempHumidity":
-		// Generate temperature and humidity, triggering alert if in top 15% of range
-		temperature := round(rand.Float64()*80+20, 2) // 20 to 100 degrees Celsius
-		humidity := round(rand.Float64()*50+30, 1)    // 30 to 80% humidity
-		data.Temperature = &temperature
-		data.Humidity = &humidity
-
-		// Trigger alert if temperature is in the top 15% of the range
-		if temperature > 100*0.90 {
-			data.Status = "Alert"
-		}
-
-		// Trigger alert if humidity is in the top 15% of the range
-		if humidity > 80*0.90 {
-			data.Status = "Alert"
-		}
-	case "Flow":
-		// Generate flow rate and trigger alert if in top 15% of range
-		flowRate := round(rand.Float64()*250+50, 2) // 50 to 300 L/min
-		data.FlowRate = &flowRate
-		if flowRate > 300*0.90 {
-			data.Status = "Alert"
-		}
-	case "Vibration":
-		// Generate vibration and trigger alert if in top 15% of range
-		vibration := round(rand.Float64()*2, 2) // 0 to 2 G (acceleration)
-		data.Vibration = &vibration
-		if vibration > 2*0.90 {
-			data.Status = "Alert"
-		}
-	case "Power":
-		// Generate power consumption and trigger alert if in top 15% of range
-		powerConsumption := round(rand.Float64()*100+50, 2) // 50 to 150 W
-		data.PowerConsumption = &powerConsumption
-		if powerConsumption > 150*0.90 {
-			data.Status = "Alert"
-		}
+	for _, m := range metrics {
+		data.Metrics[m.Name] = sampler.sample(m.Name)
 	}
-
 	return data
 }
 
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// modbusPublisher writes OT data to the registers of the Modbus server over one long-lived connection
+type modbusPublisher struct {
+	handler *modbus.TCPClientHandler
+	client  modbus.Client
+}
+
+// Connect and Publish check ctx between requests, the Modbus client cannot
+// abort one in flight, which the handler timeout bounds to a second
+func (p *modbusPublisher) Connect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	config := current().config
+	handler := modbus.NewTCPClientHandler(fmt.Sprintf("%s:%d", config.ModBus.Address, config.ModBus.Port))
+	handler.Timeout = 1 * time.Second
+	handler.IdleTimeout = 0 // keep the connection open between rounds
+	handler.SlaveId = 1
+	handler.Logger = log.New(os.Stdout, "modbus: ", log.LstdFlags)
+
+	if err := handler.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to Modbus server on %s:%d: %v", config.ModBus.Address, config.ModBus.Port, err)
+	}
+	p.handler = handler
+	p.client = modbus.NewClient(handler)
+	return nil
+}
+
+func (p *modbusPublisher) Publish(ctx context.Context, device *Device, data OTData) error {
+	m, ok := current().registerMaps[device.ID]
+	if !ok {
+		return fmt.Errorf("no register map for device %s", device.ID)
+	}
+	p.handler.SlaveId = m.UnitID
+
+	for _, w := range m.registerWrites(data) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Convert []uint16 to []byte
+		registerBytes := make([]byte, len(w.words)*2)
+		for i, reg := range w.words {
+			registerBytes[i*2] = byte(reg >> 8)
+			registerBytes[i*2+1] = byte(reg & 0xFF)
+		}
+		if _, err := p.client.WriteMultipleRegisters(w.address, uint16(len(w.words)), registerBytes); err != nil {
+			return fmt.Errorf("failed to write data to Modbus for device %s: %v", device.ID, err)
+		}
+	}
+
+	for _, c := range m.Coils {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var value uint16
+		if c.on(data) {
+			value = 0xFF00
+		}
+		if _, err := p.client.WriteSingleCoil(c.Address, value); err != nil {
+			return fmt.Errorf("failed to write coil %s to Modbus for device %s: %v", c.Name, device.ID, err)
+		}
+	}
+	return nil
+}
+
+// Target names the unit and the registers and coils the map of the device spans
+func (p *modbusPublisher) Target(device *Device) string {
+	m, ok := current().registerMaps[device.ID]
+	if !ok {
+		return ""
+	}
+	return m.String()
+}
+
+func (p *modbusPublisher) Close() error {
+	if p.handler == nil {
+		return nil
+	}
+	err := p.handler.Close()
+	p.handler = nil
+	p.client = nil
+	return err
+}
+
+func (p *modbusPublisher) Health() error {
+	if p.handler == nil {
+		return errNotConnected
+	}
+	return nil
+}
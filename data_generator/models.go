@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ModelConfig configures the signal model of one metric. Which fields are
+// used depends on Kind:
+//
+//	random_walk  start, step
+//	diurnal      mean, amplitude, peak_hour, noise
+//	ou           mean, theta, sigma (Ornstein-Uhlenbeck, mean reverting noise)
+//	step         levels, hold_s, noise
+//	correlated   source, gain, offset, noise (follows another metric)
+//	counter      start, step (adds step every reading, wraps back to start above max)
+//	integral     source, gain, start (adds gain * source per second, a kWh meter over kW)
+//
+// min and max clamp the value for every kind, decimals rounds it.
+type ModelConfig struct {
+	Kind      string    `json:"kind"`
+	Start     float64   `json:"start"`
+	Step      float64   `json:"step"`
+	Mean      float64   `json:"mean"`
+	Amplitude float64   `json:"amplitude"`
+	PeakHour  float64   `json:"peak_hour"`
+	Theta     float64   `json:"theta"`
+	Sigma     float64   `json:"sigma"`
+	Noise     float64   `json:"noise"`
+	Levels    []float64 `json:"levels"`
+	HoldS     float64   `json:"hold_s"`
+	Source    string    `json:"source"`
+	Gain      float64   `json:"gain"`
+	Offset    float64   `json:"offset"`
+	Min       *float64  `json:"min"`
+	Max       *float64  `json:"max"`
+	Decimals  *int      `json:"decimals"`
+}
+
+// signal is the running state of a model for one metric of one device
+type signal struct {
+	cfg      ModelConfig
+	value    float64
+	last     time.Time
+	level    int
+	nextStep time.Time
+}
+
+// plant keeps the latest value of every metric of every device, so correlated models can follow other devices
+var plant = struct {
+	sync.Mutex
+	values map[string]map[string]float64
+}{values: make(map[string]map[string]float64)}
+
+// validateModel checks that a model kind is known and has what it needs
+func validateModel(cfg ModelConfig) error {
+	switch cfg.Kind {
+	case "random_walk", "diurnal", "ou", "correlated", "counter", "integral":
+		if (cfg.Kind == "correlated" || cfg.Kind == "integral") && cfg.Source == "" {
+			return fmt.Errorf("%s model needs a source metric", cfg.Kind)
+		}
+	case "step":
+		if len(cfg.Levels) == 0 {
+			return fmt.Errorf("step model needs levels")
+		}
+	default:
+		return fmt.Errorf("unknown model kind %q", cfg.Kind)
+	}
+	if cfg.Min != nil && cfg.Max != nil && *cfg.Min > *cfg.Max {
+		return fmt.Errorf("model min %v is above max %v", *cfg.Min, *cfg.Max)
+	}
+	return nil
+}
+
+// modelsFor merges the configured models of a device type over the ones of its catalogue entry
+func modelsFor(deviceType string, spec DeviceTypeSpec, configured map[string]map[string]ModelConfig) (map[string]*signal, error) {
+	signals := make(map[string]*signal)
+	for _, m := range spec.Metrics {
+		signals[m.Name] = newSignal(m.Model)
+	}
+	for metric, cfg := range configured[deviceType] {
+		if _, ok := spec.metric(metric); !ok {
+			return nil, fmt.Errorf("model for %s %s: %s has no metric %s", deviceType, metric, deviceType, metric)
+		}
+		if err := validateModel(cfg); err != nil {
+			return nil, fmt.Errorf("model for %s %s: %v", deviceType, metric, err)
+		}
+		signals[metric] = newSignal(cfg)
+	}
+	return signals, nil
+}
+
+func newSignal(cfg ModelConfig) *signal {
+	s := &signal{cfg: cfg}
+	switch cfg.Kind {
+	case "random_walk", "counter", "integral":
+		s.value = cfg.Start
+	case "step":
+		s.value = cfg.Levels[0]
+	default:
+		s.value = cfg.Mean
+	}
+	return s
+}
+
+// next advances the model to now and returns the new value. related looks up
+// the current value of another metric for correlated models.
+func (s *signal) next(now time.Time, related func(metric string) (float64, bool)) float64 {
+	dt := 1.0
+	if !s.last.IsZero() {
+		dt = now.Sub(s.last).Seconds()
+	}
+	s.last = now
+
+	cfg := s.cfg
+	switch cfg.Kind {
+	case "random_walk":
+		s.value += (rng.Float64()*2 - 1) * cfg.Step
+	case "diurnal":
+		hour := float64(now.Hour()) + float64(now.Minute())/60
+		s.value = cfg.Mean + cfg.Amplitude*math.Cos(2*math.Pi*(hour-cfg.PeakHour)/24) + rng.NormFloat64()*cfg.Noise
+	case "ou":
+		s.value += cfg.Theta*(cfg.Mean-s.value)*dt + cfg.Sigma*math.Sqrt(dt)*rng.NormFloat64()
+	case "step":
+		if now.After(s.nextStep) {
+			if !s.nextStep.IsZero() {
+				s.level = rng.Intn(len(cfg.Levels))
+			}
+			hold := cfg.HoldS
+			if hold <= 0 {
+				hold = 300
+			}
+			// Exponentially distributed hold times look like operator actions
+			s.nextStep = now.Add(time.Duration(rng.ExpFloat64() * hold * float64(time.Second)))
+		}
+		s.value = cfg.Levels[s.level] + rng.NormFloat64()*cfg.Noise
+	case "correlated":
+		if source, ok := related(cfg.Source); ok {
+			s.value = cfg.Offset + cfg.Gain*source + rng.NormFloat64()*cfg.Noise
+		}
+	case "counter":
+		s.value += cfg.Step
+		// PLC counters roll over instead of saturating
+		if cfg.Max != nil && s.value > *cfg.Max {
+			s.value = cfg.Start
+		}
+	case "integral":
+		if source, ok := related(cfg.Source); ok {
+			s.value += cfg.Gain * source * dt
+		}
+	}
+
+	if cfg.Min != nil && s.value < *cfg.Min {
+		s.value = *cfg.Min
+	}
+	if cfg.Max != nil && s.value > *cfg.Max {
+		s.value = *cfg.Max
+	}
+
+	decimals := 2
+	if cfg.Decimals != nil {
+		decimals = *cfg.Decimals
+	}
+	return round(s.value, decimals)
+}
+
+// recordPlantValue stores the latest value of a device metric
+func recordPlantValue(deviceID, metric string, value float64) {
+	plant.Lock()
+	defer plant.Unlock()
+
+	if plant.values[metric] == nil {
+		plant.values[metric] = make(map[string]float64)
+	}
+	plant.values[metric][deviceID] = value
+}
+
+// plantAverage returns the average of a metric over every device that reported it
+func plantAverage(metric string) (float64, bool) {
+	plant.Lock()
+	defer plant.Unlock()
+
+	values := plant.values[metric]
+	if len(values) == 0 {
+		return 0, false
+	}
+	// Summed in device order, a float sum in map order could differ between seeded runs
+	devices := make([]string, 0, len(values))
+	for device := range values {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	sum := 0.0
+	for _, device := range devices {
+		sum += values[device]
+	}
+	return sum / float64(len(values)), true
+}
+
+// metricSampler draws the metrics of one reading from the models of a device
+type metricSampler struct {
+	deviceID string
+	signals  map[string]*signal
+	now      time.Time
+	values   map[string]float64
+}
+
+func newMetricSampler(deviceID string, signals map[string]*signal, now time.Time) *metricSampler {
+	return &metricSampler{deviceID: deviceID, signals: signals, now: now, values: make(map[string]float64)}
+}
+
+// sample returns the next value of a metric, a replayed value if there is one
+func (s *metricSampler) sample(metric string) float64 {
+	var value float64
+	if v, ok := current().replay.Value(s.deviceID, metric, s.now); ok {
+		value = v
+	} else if sig, ok := s.signals[metric]; ok {
+		value = sig.next(s.now, s.related)
+	}
+	s.values[metric] = value
+	recordPlantValue(s.deviceID, metric, value)
+	return value
+}
+
+// related prefers a metric of the same reading and falls back to the plant wide average
+func (s *metricSampler) related(metric string) (float64, bool) {
+	if v, ok := s.values[metric]; ok {
+		return v, true
+	}
+	return plantAverage(metric)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func float(v float64) *float64 { return &v }
+
+func TestValidateModel(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ModelConfig
+		want string // part of the error, empty when the model is valid
+	}{
+		{"random walk", ModelConfig{Kind: "random_walk", Step: 1}, ""},
+		{"correlated", ModelConfig{Kind: "correlated", Source: "flow_rate"}, ""},
+		{"correlated without source", ModelConfig{Kind: "correlated"}, "correlated model needs a source metric"},
+		{"integral without source", ModelConfig{Kind: "integral"}, "integral model needs a source metric"},
+		{"step", ModelConfig{Kind: "step", Levels: []float64{0, 1}}, ""},
+		{"step without levels", ModelConfig{Kind: "step"}, "step model needs levels"},
+		{"unknown kind", ModelConfig{Kind: "sine"}, `unknown model kind "sine"`},
+		{"min equals max", ModelConfig{Kind: "ou", Min: float(5), Max: float(5)}, ""},
+		{"min above max", ModelConfig{Kind: "ou", Min: float(6), Max: float(5)}, "model min 6 is above max 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateModel(tt.cfg)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("validateModel() = %v, want no error", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("validateModel() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelsFor(t *testing.T) {
+	spec := DeviceTypeSpec{Metrics: []MetricSpec{
+		{Name: "temperature", Model: ModelConfig{Kind: "ou", Mean: 20}},
+		{Name: "pressure", Model: ModelConfig{Kind: "random_walk", Start: 1}},
+	}}
+	tests := []struct {
+		name       string
+		configured map[string]map[string]ModelConfig
+		want       map[string]float64 // start value of every signal
+		wantErr    string
+	}{
+		{"catalogue models", nil, map[string]float64{"temperature": 20, "pressure": 1}, ""},
+		{
+			"configured model replaces the catalogue one",
+			map[string]map[string]ModelConfig{"Boiler": {"pressure": {Kind: "step", Levels: []float64{4, 8}}}},
+			map[string]float64{"temperature": 20, "pressure": 4},
+			"",
+		},
+		{
+			"models of other types are left alone",
+			map[string]map[string]ModelConfig{"Pump": {"flow_rate": {Kind: "ou"}}},
+			map[string]float64{"temperature": 20, "pressure": 1},
+			"",
+		},
+		{
+			"unknown metric",
+			map[string]map[string]ModelConfig{"Boiler": {"flow_rate": {Kind: "ou"}}},
+			nil,
+			"model for Boiler flow_rate: Boiler has no metric flow_rate",
+		},
+		{
+			"invalid model",
+			map[string]map[string]ModelConfig{"Boiler": {"pressure": {Kind: "step"}}},
+			nil,
+			"model for Boiler pressure: step model needs levels",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signals, err := modelsFor("Boiler", spec, tt.configured)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("modelsFor() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("modelsFor() = %v", err)
+			}
+			if len(signals) != len(tt.want) {
+				t.Errorf("modelsFor() has %d signals, want %d", len(signals), len(tt.want))
+			}
+			for metric, start := range tt.want {
+				if s, ok := signals[metric]; !ok || s.value != start {
+					t.Errorf("signal %s starts at %v, want %v", metric, signals[metric], start)
+				}
+			}
+		})
+	}
+}
+
+func TestSignalNext(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	related := func(values map[string]float64) func(string) (float64, bool) {
+		return func(metric string) (float64, bool) {
+			v, ok := values[metric]
+			return v, ok
+		}
+	}
+	decimals := func(d int) *int { return &d }
+
+	tests := []struct {
+		name     string
+		cfg      ModelConfig
+		related  map[string]float64
+		interval time.Duration
+		want     []float64 // values of consecutive readings
+	}{
+		{
+			name: "counter rolls over above max",
+			cfg:  ModelConfig{Kind: "counter", Start: 0, Step: 4, Max: float(10)},
+			want: []float64{4, 8, 0, 4},
+		},
+		{
+			name: "counter without max keeps counting",
+			cfg:  ModelConfig{Kind: "counter", Start: 100, Step: 1},
+			want: []float64{101, 102, 103},
+		},
+		{
+			name:     "integral adds gain times source per second",
+			cfg:      ModelConfig{Kind: "integral", Source: "power", Gain: 0.5, Start: 10},
+			related:  map[string]float64{"power": 2},
+			interval: 3 * time.Second,
+			want:     []float64{11, 14, 17},
+		},
+		{
+			name:    "integral holds without its source",
+			cfg:     ModelConfig{Kind: "integral", Source: "power", Gain: 1, Start: 10},
+			related: map[string]float64{},
+			want:    []float64{10, 10},
+		},
+		{
+			name:    "correlated follows its source",
+			cfg:     ModelConfig{Kind: "correlated", Source: "flow_rate", Gain: 2, Offset: 1},
+			related: map[string]float64{"flow_rate": 3},
+			want:    []float64{7, 7},
+		},
+		{
+			name: "ou without noise reverts to the mean",
+			cfg:  ModelConfig{Kind: "ou", Mean: 10, Theta: 0.5},
+			want: []float64{10, 10},
+		},
+		{
+			name: "diurnal peaks at the peak hour",
+			cfg:  ModelConfig{Kind: "diurnal", Mean: 20, Amplitude: 5, PeakHour: 12},
+			want: []float64{25},
+		},
+		{
+			name: "diurnal is lowest half a day from the peak",
+			cfg:  ModelConfig{Kind: "diurnal", Mean: 20, Amplitude: 5, PeakHour: 0},
+			want: []float64{15},
+		},
+		{
+			name: "single step level",
+			cfg:  ModelConfig{Kind: "step", Levels: []float64{42}},
+			want: []float64{42, 42},
+		},
+		{
+			name: "clamped to min",
+			cfg:  ModelConfig{Kind: "counter", Start: 0, Step: -5, Min: float(-8)},
+			want: []float64{-5, -8, -8},
+		},
+		{
+			name:    "clamped to max",
+			cfg:     ModelConfig{Kind: "correlated", Source: "x", Gain: 1, Max: float(3)},
+			related: map[string]float64{"x": 9},
+			want:    []float64{3},
+		},
+		{
+			name: "rounded to two decimals by default",
+			cfg:  ModelConfig{Kind: "counter", Step: 0.123},
+			want: []float64{0.12, 0.25},
+		},
+		{
+			name: "rounded to the configured decimals",
+			cfg:  ModelConfig{Kind: "counter", Step: 1.26, Decimals: decimals(0)},
+			want: []float64{1, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSignal(tt.cfg)
+			interval := tt.interval
+			if interval == 0 {
+				interval = time.Second
+			}
+			now := start
+			for i, want := range tt.want {
+				if got := s.next(now, related(tt.related)); got != want {
+					t.Errorf("reading %d = %v, want %v", i, got, want)
+				}
+				now = now.Add(interval)
+			}
+		})
+	}
+}
+
+func TestMetricSamplerRelated(t *testing.T) {
+	running.Store(&snapshot{})
+	t.Cleanup(func() { running.Store(nil) })
+	recordPlantValue("TEST-A", "test_level", 2)
+	recordPlantValue("TEST-B", "test_level", 4)
+
+	s := newMetricSampler("TEST-C", map[string]*signal{
+		"test_flow": newSignal(ModelConfig{Kind: "counter", Step: 5}),
+	}, time.Now())
+	tests := []struct {
+		metric string
+		want   float64
+		wantOK bool
+	}{
+		{"test_level", 3, true}, // plant wide average
+		{"test_unknown", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := s.related(tt.metric); got != tt.want || ok != tt.wantOK {
+			t.Errorf("related(%s) = %v, %v, want %v, %v", tt.metric, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	// A metric of the same reading goes before the plant average
+	recordPlantValue("TEST-A", "test_flow", 100)
+	if got := s.sample("test_flow"); got != 5 {
+		t.Errorf("sample(test_flow) = %v, want 5", got)
+	}
+	if got, _ := s.related("test_flow"); got != 5 {
+		t.Errorf("related(test_flow) = %v, want the sampled 5", got)
+	}
+}
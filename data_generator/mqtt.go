@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttPublisher publishes OT data to the MQTT broker. Every device has its own
+// long-lived session, so each can leave a Last Will that marks it offline.
+// With Homie on a device has a second session, as Homie needs a Will of its own.
+type mqttPublisher struct {
+	started   bool
+	sessions  map[string]mqtt.Client
+	homie     map[string]mqtt.Client
+	announced map[string]discoveryState // kept across reconnects, to clear what a reload turned off
+}
+
+// mqttClientOptions returns the broker, credential and TLS settings shared by every MQTT session
+func mqttClientOptions(clientID string) (*mqtt.ClientOptions, error) {
+	c := current().config.MQTT
+	scheme := "tcp"
+	opts := mqtt.NewClientOptions()
+	if c.TLS.Enabled {
+		tlsConfig, err := mqttTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		scheme = "ssl"
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.AddBroker(fmt.Sprintf("%s://%s:%d", scheme, c.Address, c.Port))
+	opts.SetUsername(c.Username)
+	opts.SetPassword(c.Password)
+	opts.SetClientID(clientID)
+	opts.SetKeepAlive(time.Duration(c.KeepAliveS) * time.Second)
+	return opts, nil
+}
+
+func mqttTLSConfig() (*tls.Config, error) {
+	c := current().config.MQTT.TLS
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.SkipVerify}
+	if c.CAFile != "" {
+		ca, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read MQTT CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in MQTT CA file %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load MQTT client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// waitToken waits for an MQTT operation to complete, or for ctx to be done first
+func waitToken(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// mqttTopic is the base topic of a device, the data topic the generator always used
+func mqttTopic(device *Device) string {
+	return fmt.Sprintf("ot/device/%s/%s", device.Type, device.ID)
+}
+
+func (p *mqttPublisher) Connect(ctx context.Context) error {
+	// Sessions are opened per device on its first publish
+	p.sessions = make(map[string]mqtt.Client)
+	p.homie = make(map[string]mqtt.Client)
+	if p.announced == nil {
+		p.announced = make(map[string]discoveryState)
+	}
+	p.started = true
+	return nil
+}
+
+// session returns the MQTT session of a device, connecting it the first time
+func (p *mqttPublisher) session(ctx context.Context, device *Device) (mqtt.Client, error) {
+	if client, ok := p.sessions[device.ID]; ok {
+		return client, nil
+	}
+
+	c := current().config.MQTT
+	// The Homie session goes first, a device is only connected once it has every session it needs
+	if c.Discovery.Homie && p.homie[device.ID] == nil {
+		if err := p.homieSession(ctx, device); err != nil {
+			return nil, err
+		}
+	}
+	opts, err := mqttClientOptions(c.ClientIDPrefix + device.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	statusTopic := mqttTopic(device) + "/status"
+	opts.SetWill(statusTopic, "offline", c.QoS.Status, true)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(30 * time.Second)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		// Runs on every (re)connect, replacing the Will the broker may have published meanwhile
+		s := current()
+		c := s.config.MQTT
+		client.Publish(statusTopic, c.QoS.Status, true, "online")
+		client.Subscribe(mqttTopic(device)+"/ack", c.QoS.Status, func(_ mqtt.Client, msg mqtt.Message) {
+			ackMQTT(device, msg)
+		})
+		if payload, ok := s.honeytokens.deviceConfig(device); ok {
+			client.Publish(mqttTopic(device)+"/config", c.QoS.Status, true, payload)
+		}
+		if c.Discovery.HomeAssistant {
+			publishHomeAssistant(client, device)
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Printf("MQTT session of %s lost, reconnecting: %v", device.ID, err)
+	})
+
+	client := mqtt.NewClient(opts)
+	if err := waitToken(ctx, client.Connect()); err != nil {
+		// Stop the connection attempt, it would otherwise go on in the background
+		client.Disconnect(0)
+		return nil, fmt.Errorf("failed to connect to MQTT broker on %s:%d: %v", c.Address, c.Port, err)
+	}
+	p.sessions[device.ID] = client
+
+	var announce discoveryState
+	if c.Discovery.HomeAssistant {
+		announce.homeAssistant = c.Discovery.HomeAssistantPrefix
+	}
+	announce.homie = c.Discovery.Homie
+	// Retained configs stay on the broker until cleared, Home Assistant and Homie controllers would keep showing the device
+	previous := p.announced[device.ID]
+	if previous.homeAssistant != "" && previous.homeAssistant != announce.homeAssistant {
+		clearHomeAssistant(client, device, previous.homeAssistant)
+	}
+	if previous.homie && !announce.homie {
+		clearHomie(client, device)
+	}
+	p.announced[device.ID] = announce
+	return client, nil
+}
+
+// homieSession connects the Homie session of a device. Its Will marks the
+// device lost, the Homie counterpart of the offline status of the main session.
+func (p *mqttPublisher) homieSession(ctx context.Context, device *Device) error {
+	c := current().config.MQTT
+	opts, err := mqttClientOptions(c.ClientIDPrefix + device.ID + "-homie")
+	if err != nil {
+		return err
+	}
+	opts.SetWill(homieTopic(device)+"/$state", "lost", c.QoS.Status, true)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(30 * time.Second)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		publishHomie(client, device)
+	})
+
+	client := mqtt.NewClient(opts)
+	if err := waitToken(ctx, client.Connect()); err != nil {
+		client.Disconnect(0)
+		return fmt.Errorf("failed to connect Homie session of %s to MQTT broker on %s:%d: %v", device.ID, c.Address, c.Port, err)
+	}
+	p.homie[device.ID] = client
+	return nil
+}
+
+func (p *mqttPublisher) Publish(ctx context.Context, device *Device, data OTData) error {
+	c := current().config.MQTT
+	client, err := p.session(ctx, device)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to generate data for device %s: %v", device.ID, err)
+	}
+
+	topic := mqttTopic(device)
+	if err := waitToken(ctx, client.Publish(topic, c.QoS.Data, false, payload)); err != nil {
+		return fmt.Errorf("failed to publish data for device %s: %v", device.ID, err)
+	}
+
+	// An empty list rather than null when the device has no alarms
+	alarms, err := json.Marshal(append([]Alarm{}, data.Alarms...))
+	if err != nil {
+		return fmt.Errorf("failed to generate alarms for device %s: %v", device.ID, err)
+	}
+
+	// Retained last known values, what a subscriber sees first when it connects
+	values := map[string]string{"state": data.Status, "alarm_code": strconv.Itoa(data.AlarmCode), "alarms": string(alarms)}
+	for name, value := range data.Metrics {
+		values[name] = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	if err := publishRetained(ctx, client, device, topic+"/", values); err != nil {
+		return err
+	}
+	if homie, ok := p.homie[device.ID]; ok {
+		return publishRetained(ctx, homie, device, "", homieValues(device, data))
+	}
+	return nil
+}
+
+// publishRetained publishes retained values on prefix followed by their name, in name order
+func publishRetained(ctx context.Context, client mqtt.Client, device *Device, prefix string, values map[string]string) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := waitToken(ctx, client.Publish(prefix+name, current().config.MQTT.QoS.Values, true, values[name])); err != nil {
+			return fmt.Errorf("failed to publish %s for device %s: %v", prefix+name, device.ID, err)
+		}
+	}
+	return nil
+}
+
+func (p *mqttPublisher) Target(device *Device) string {
+	return mqttTopic(device)
+}
+
+// ackMQTT acknowledges the alarm whose code is in an ack message, or every alarm of the device for an empty payload or "all"
+func ackMQTT(device *Device, msg mqtt.Message) {
+	payload := strings.TrimSpace(string(msg.Payload()))
+	code := 0
+	if payload != "" && payload != "all" {
+		var err error
+		if code, err = strconv.Atoi(payload); err != nil {
+			log.Printf("Ignoring MQTT acknowledgement %q on %s", payload, msg.Topic())
+			return
+		}
+	}
+	device.Ack(code, "MQTT")
+}
+
+// Close marks every device offline and ends its sessions, a clean disconnect does not trigger the Wills
+func (p *mqttPublisher) Close() error {
+	s := current()
+	c := s.config.MQTT
+	for id, client := range p.sessions {
+		if client.IsConnectionOpen() {
+			if device, ok := s.fleet.byID[id]; ok {
+				client.Publish(mqttTopic(device)+"/status", c.QoS.Status, true, "offline").WaitTimeout(time.Second)
+			}
+		}
+		client.Disconnect(250)
+	}
+	for id, client := range p.homie {
+		if client.IsConnectionOpen() {
+			client.Publish("homie/"+homieID(id)+"/$state", c.QoS.Status, true, "disconnected").WaitTimeout(time.Second)
+		}
+		client.Disconnect(250)
+	}
+	p.sessions = nil
+	p.homie = nil
+	p.started = false
+	return nil
+}
+
+// Health reports a problem only when no device session is up, single sessions reconnect by themselves
+func (p *mqttPublisher) Health() error {
+	if !p.started {
+		return errNotConnected
+	}
+	if len(p.sessions) == 0 {
+		return nil
+	}
+	for _, client := range p.sessions {
+		if client.IsConnectionOpen() {
+			return nil
+		}
+	}
+	return fmt.Errorf("connection to MQTT broker lost")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Publisher sends OT data over one protocol. Connections are long-lived: a
+// publisher is connected on first use and stays connected between rounds.
+type Publisher interface {
+	// Connect opens the connection, it is called whenever Health reports a problem.
+	// It gives up when ctx is done.
+	Connect(ctx context.Context) error
+	// Publish sends one reading of a device, giving up when ctx is done
+	Publish(ctx context.Context, device *Device, data OTData) error
+	// Close drops the connection, the next round connects again
+	Close() error
+	// Health returns nil while the publisher can publish
+	Health() error
+}
+
+// publisherEntry is a registered publisher, rounds on the same publisher never overlap
+type publisherEntry struct {
+	name        string
+	displayName string
+	publisher   Publisher
+	mu          sync.Mutex
+	status      atomic.Value // health after the last round, readable while a round runs
+}
+
+var (
+	publishers     []*publisherEntry
+	publishersByID = make(map[string]*publisherEntry)
+)
+
+// init registers the built-in publishers, in the order the web page lists them
+func init() {
+	registerPublisher("mqtt", "MQTT", &mqttPublisher{})
+	registerPublisher("modbus", "Modbus", &modbusPublisher{})
+	registerPublisher("coap", "CoAP", &coapPublisher{})
+	registerPublisher("sparkplug", "Sparkplug B", &sparkplugPublisher{})
+}
+
+// registerPublisher makes a publisher available as a service under name
+func registerPublisher(name, displayName string, p Publisher) {
+	entry := &publisherEntry{name: name, displayName: displayName, publisher: p}
+	publishers = append(publishers, entry)
+	publishersByID[name] = entry
+}
+
+// errRoundBusy is returned for a round asked for while another round of the same service still runs
+var errRoundBusy = errors.New("previous round still running")
+
+// publishRound publishes a reading for every device of the service whose
+// interval has elapsed. A round already running is not waited for, and a
+// cancelled ctx stops the round, also while it connects or publishes.
+func (e *publisherEntry) publishRound(ctx context.Context) (int, error) {
+	if !e.mu.TryLock() {
+		return 0, errRoundBusy
+	}
+	defer e.mu.Unlock()
+	defer e.updateHealth()
+
+	if e.publisher.Health() != nil {
+		// Drop whatever is left of a lost connection before starting over
+		e.publisher.Close()
+		if err := e.publisher.Connect(ctx); err != nil {
+			events.Publish(PublishEvent{Time: time.Now(), Service: e.name, Error: err.Error()})
+			return 0, err
+		}
+	}
+
+	sent := 0
+	for _, device := range current().fleet.Due(e.name, time.Now()) {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+		data := device.Reading(time.Now())
+		err := e.publisher.Publish(ctx, device, data)
+		publishEvent(e, device, data, err)
+		if err != nil {
+			// A broken connection shows in Health, the next round reconnects
+			return sent, err
+		}
+		device.MarkPublished(e.name, time.Now())
+		sent++
+	}
+	return sent, nil
+}
+
+// updateHealth stores the health of the publisher, e.mu must be held
+func (e *publisherEntry) updateHealth() {
+	if err := e.publisher.Health(); err != nil {
+		e.status.Store(err.Error())
+	} else {
+		e.status.Store("ok")
+	}
+}
+
+// health returns the health of the publisher after its last round as text for the API
+func (e *publisherEntry) health() string {
+	if status, ok := e.status.Load().(string); ok {
+		return status
+	}
+	return errNotConnected.Error()
+}
+
+// closePublishers closes the connection of every publisher
+func closePublishers() {
+	for _, e := range publishers {
+		e.mu.Lock()
+		if err := e.publisher.Close(); err != nil {
+			log.Printf("Error closing %s: %v", e.displayName, err)
+		}
+		e.updateHealth()
+		e.mu.Unlock()
+	}
+}
+
+// errNotConnected is the health of a publisher that has not connected yet
+var errNotConnected = errors.New("not connected")
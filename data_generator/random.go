@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var seed = flag.Int64("seed", 0, "Seed every random value with this, the same seed and config generate the same data (0 seeds from the clock)")
+
+// rng is the source of every random value of the generator, so one seed makes a run reproducible
+var rng = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano()).(rand.Source64)})
+
+// lockedSource makes a rand.Source safe for the publishers, which sample concurrently
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// seedRandom applies -seed, it has to run before the fleet is created
+func seedRandom() {
+	if *seed != 0 {
+		rng.Seed(*seed)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// RegisterPoint maps one value of a device onto holding registers
+type RegisterPoint struct {
+	Name      string  `json:"name"`       // metric name, "timestamp" for the Unix time of the reading, "state", "alarm_code" or "api_key" for the honeytoken
+	Address   uint16  `json:"address"`    // first holding register
+	Type      string  `json:"type"`       // int16, uint16, int32, uint32, float32 or string
+	WordOrder string  `json:"word_order"` // big (high word first, default) or little, for 32-bit types
+	Scale     float64 `json:"scale"`      // the value is multiplied by scale before encoding, default 1
+	Length    int     `json:"length"`     // registers of a string, two characters each
+}
+
+// CoilPoint maps a status bit of a device onto a coil
+type CoilPoint struct {
+	Name    string `json:"name"`
+	Address uint16 `json:"address"`
+	When    string `json:"when"` // a state the coil is on in, or "alarm" or "unacked"
+}
+
+// on reports whether the coil is on for a reading: in its state, while an
+// alarm is active for "alarm", or while an alarm waits for acknowledgement for "unacked"
+func (c CoilPoint) on(data OTData) bool {
+	switch c.When {
+	case "alarm":
+		return data.AlarmCode != 0
+	case "unacked":
+		for _, a := range data.Alarms {
+			if !a.Acked {
+				return true
+			}
+		}
+		return false
+	}
+	return data.Status == c.When
+}
+
+// RegisterMap is the Modbus layout of one device. The same file is loaded by
+// the Modbus honeypot to name the registers attackers touch.
+type RegisterMap struct {
+	UnitID    byte            `json:"unit_id"`
+	Registers []RegisterPoint `json:"registers"`
+	Coils     []CoilPoint     `json:"coils"`
+}
+
+// maxUnitID is the highest Modbus unit id a device without a configured map can get
+const maxUnitID = 247
+
+// apiKeyRegisters holds an API key honeytoken of 32 characters
+const apiKeyRegisters = 16
+
+// loadRegisterMaps reads the per-device register maps. The honeypot names
+// points from the same file, so with a file every Modbus device of the fleet
+// must be in it; without one every device gets a default map on a unit of its own.
+func loadRegisterMaps(path string, f *Fleet, tokens *honeytokenSet) (map[string]*RegisterMap, error) {
+	maps := make(map[string]*RegisterMap)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read register map: %v", err)
+		}
+		if err := json.Unmarshal(data, &maps); err != nil {
+			return nil, fmt.Errorf("could not parse register map: %v", err)
+		}
+	}
+
+	for i, d := range f.Devices("modbus") {
+		if _, ok := maps[d.ID]; ok {
+			continue
+		}
+		if path != "" {
+			return nil, fmt.Errorf("register map %s has no layout for Modbus device %s", path, d.ID)
+		}
+		if i >= maxUnitID {
+			return nil, fmt.Errorf("more than %d Modbus devices need a register map", maxUnitID)
+		}
+		maps[d.ID] = defaultRegisterMap(d, byte(i+1), tokens.token(d.ID, tokenAPIKey) != nil)
+	}
+	for id, m := range maps {
+		if m.UnitID == 0 {
+			m.UnitID = 1
+		}
+		for i := range m.Registers {
+			if m.Registers[i].Scale == 0 {
+				m.Registers[i].Scale = 1
+			}
+		}
+		if err := m.validate(); err != nil {
+			return nil, fmt.Errorf("register map of %s: %v", id, err)
+		}
+	}
+	if err := checkOverlaps(maps); err != nil {
+		return nil, err
+	}
+	return maps, nil
+}
+
+// defaultRegisterMap puts the timestamp, every metric of a device type as
+// float32, the state, the alarm code and optionally the API key honeytoken on
+// unit from address 0. The coils are alarm, unacked and one per state from
+// Starting to Fault.
+func defaultRegisterMap(d *Device, unit byte, apiKey bool) *RegisterMap {
+	m := &RegisterMap{
+		UnitID:    unit,
+		Registers: []RegisterPoint{{Name: "timestamp", Address: 0, Type: "uint32"}},
+		Coils:     []CoilPoint{{Name: "alarm", Address: 0, When: "alarm"}, {Name: "unacked", Address: 1, When: "unacked"}},
+	}
+	address := uint16(2)
+	for _, metric := range d.metrics {
+		m.Registers = append(m.Registers, RegisterPoint{Name: metric.Name, Address: address, Type: "float32"})
+		address += 2
+	}
+	m.Registers = append(m.Registers,
+		RegisterPoint{Name: "state", Address: address, Type: "uint16"},
+		RegisterPoint{Name: "alarm_code", Address: address + 1, Type: "uint16"})
+	if apiKey {
+		m.Registers = append(m.Registers, RegisterPoint{Name: tokenAPIKey, Address: address + 2, Type: "string", Length: apiKeyRegisters})
+	}
+	for i, state := range deviceStates[1:] {
+		m.Coils = append(m.Coils, CoilPoint{Name: strings.ToLower(state), Address: 2 + uint16(i), When: state})
+	}
+	return m
+}
+
+func (m *RegisterMap) validate() error {
+	for _, p := range m.Registers {
+		if p.Type == "string" && p.Length <= 0 {
+			return fmt.Errorf("string register %s needs a length", p.Name)
+		}
+		if registerWidth(p) == 0 {
+			return fmt.Errorf("register %s has unknown type %q", p.Name, p.Type)
+		}
+		if p.WordOrder != "" && p.WordOrder != "big" && p.WordOrder != "little" {
+			return fmt.Errorf("register %s has unknown word order %q", p.Name, p.WordOrder)
+		}
+	}
+	for _, c := range m.Coils {
+		if c.When != "alarm" && c.When != "unacked" && !knownState(c.When) {
+			return fmt.Errorf("coil %s has unknown condition %q", c.Name, c.When)
+		}
+	}
+	return nil
+}
+
+// String describes the map as its unit and the span of its registers and coils
+func (m *RegisterMap) String() string {
+	s := fmt.Sprintf("unit %d", m.UnitID)
+	if len(m.Registers) > 0 {
+		first, last := m.Registers[0].Address, m.Registers[0].Address
+		for _, p := range m.Registers {
+			first = min(first, p.Address)
+			last = max(last, p.Address+uint16(registerWidth(p))-1)
+		}
+		s += fmt.Sprintf(" registers %d-%d", first, last)
+	}
+	if len(m.Coils) > 0 {
+		first, last := m.Coils[0].Address, m.Coils[0].Address
+		for _, c := range m.Coils {
+			first, last = min(first, c.Address), max(last, c.Address)
+		}
+		s += fmt.Sprintf(" coils %d-%d", first, last)
+	}
+	return s
+}
+
+// checkOverlaps makes sure no two points on the same unit share an address
+func checkOverlaps(maps map[string]*RegisterMap) error {
+	type key struct {
+		unit    byte
+		coil    bool
+		address uint16
+	}
+	owners := make(map[key]string)
+	ids := make([]string, 0, len(maps))
+	for id := range maps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	claim := func(k key, owner string) error {
+		if other, taken := owners[k]; taken {
+			return fmt.Errorf("%s and %s both use address %d on unit %d", other, owner, k.address, k.unit)
+		}
+		owners[k] = owner
+		return nil
+	}
+	for _, id := range ids {
+		m := maps[id]
+		for _, p := range m.Registers {
+			for i := 0; i < registerWidth(p); i++ {
+				if err := claim(key{m.UnitID, false, p.Address + uint16(i)}, id+" "+p.Name); err != nil {
+					return err
+				}
+			}
+		}
+		for _, c := range m.Coils {
+			if err := claim(key{m.UnitID, true, c.Address}, id+" "+c.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// registerWidth returns how many registers a point takes, 0 for unknown types and strings without a length
+func registerWidth(p RegisterPoint) int {
+	switch p.Type {
+	case "int16", "uint16":
+		return 1
+	case "int32", "uint32", "float32":
+		return 2
+	case "string":
+		return max(p.Length, 0)
+	}
+	return 0
+}
+
+// encodePoint turns a value into register words. Integers are rounded and
+// clamped to their type, so a value out of range saturates instead of wrapping.
+func encodePoint(p RegisterPoint, value float64) []uint16 {
+	value *= p.Scale
+
+	var bits uint32
+	switch p.Type {
+	case "int16":
+		return []uint16{uint16(int16(clamp(math.Round(value), math.MinInt16, math.MaxInt16)))}
+	case "uint16":
+		return []uint16{uint16(clamp(math.Round(value), 0, math.MaxUint16))}
+	case "int32":
+		bits = uint32(int32(clamp(math.Round(value), math.MinInt32, math.MaxInt32)))
+	case "uint32":
+		bits = uint32(clamp(math.Round(value), 0, math.MaxUint32))
+	case "float32":
+		bits = math.Float32bits(float32(value))
+	}
+
+	if p.WordOrder == "little" {
+		return []uint16{uint16(bits), uint16(bits >> 16)}
+	}
+	return []uint16{uint16(bits >> 16), uint16(bits)}
+}
+
+// encodeString packs a string into length registers, two ASCII characters per
+// register high byte first, padded with zeros and cut off when it is longer
+func encodeString(s string, length int) []uint16 {
+	words := make([]uint16, length)
+	for i := 0; i < len(s) && i < 2*length; i++ {
+		if i%2 == 0 {
+			words[i/2] |= uint16(s[i]) << 8
+		} else {
+			words[i/2] |= uint16(s[i])
+		}
+	}
+	return words
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
+
+// maxWriteRegisters is the most registers a single Write Multiple Registers request may carry
+const maxWriteRegisters = 123
+
+// registerWrite is a contiguous run of registers written in one request
+type registerWrite struct {
+	address uint16
+	words   []uint16
+}
+
+// registerWrites encodes a reading with a register map, merging adjacent points into runs
+func (m *RegisterMap) registerWrites(data OTData) []registerWrite {
+	words := make(map[uint16]uint16)
+	for _, p := range m.Registers {
+		if p.Type == "string" {
+			// Strings only hold honeytokens, left out while they are disabled
+			if t := current().honeytokens.token(data.DeviceID, p.Name); t != nil {
+				for i, w := range encodeString(t.Value, p.Length) {
+					words[p.Address+uint16(i)] = w
+				}
+			}
+			continue
+		}
+		var value float64
+		if p.Name == "timestamp" {
+			value = float64(data.Timestamp.Unix())
+		} else if p.Name == "state" {
+			value = float64(stateCode(data.Status))
+		} else if p.Name == "alarm_code" {
+			value = float64(data.AlarmCode)
+		} else if v, ok := data.Metrics[p.Name]; ok {
+			value = v
+		} else {
+			continue
+		}
+		for i, w := range encodePoint(p, value) {
+			words[p.Address+uint16(i)] = w
+		}
+	}
+
+	addresses := make([]int, 0, len(words))
+	for a := range words {
+		addresses = append(addresses, int(a))
+	}
+	sort.Ints(addresses)
+
+	var writes []registerWrite
+	for _, a := range addresses {
+		n := len(writes)
+		if n > 0 && int(writes[n-1].address)+len(writes[n-1].words) == a && len(writes[n-1].words) < maxWriteRegisters {
+			writes[n-1].words = append(writes[n-1].words, words[uint16(a)])
+			continue
+		}
+		writes = append(writes, registerWrite{address: uint16(a), words: []uint16{words[uint16(a)]}})
+	}
+	return writes
+}
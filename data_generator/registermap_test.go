@@ -0,0 +1,308 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodePoint(t *testing.T) {
+	pi := math.Float32bits(3.14159)
+	tests := []struct {
+		name  string
+		point RegisterPoint
+		value float64
+		want  []uint16
+	}{
+		{"int16", RegisterPoint{Type: "int16", Scale: 1}, -2, []uint16{0xFFFE}},
+		{"int16 rounds", RegisterPoint{Type: "int16", Scale: 1}, 41.5, []uint16{42}},
+		{"int16 saturates high", RegisterPoint{Type: "int16", Scale: 1}, 40000, []uint16{0x7FFF}},
+		{"int16 saturates low", RegisterPoint{Type: "int16", Scale: 1}, -40000, []uint16{0x8000}},
+		{"uint16 scaled", RegisterPoint{Type: "uint16", Scale: 10}, 23.46, []uint16{235}},
+		{"uint16 saturates high", RegisterPoint{Type: "uint16", Scale: 1}, 70000, []uint16{0xFFFF}},
+		{"uint16 saturates negative", RegisterPoint{Type: "uint16", Scale: 1}, -5, []uint16{0}},
+		{"int32 big endian", RegisterPoint{Type: "int32", Scale: 1}, -2, []uint16{0xFFFF, 0xFFFE}},
+		{"int32 saturates", RegisterPoint{Type: "int32", Scale: 1}, 1e12, []uint16{0x7FFF, 0xFFFF}},
+		{"uint32 big endian", RegisterPoint{Type: "uint32", Scale: 1}, 0x12345678, []uint16{0x1234, 0x5678}},
+		{"uint32 little endian", RegisterPoint{Type: "uint32", Scale: 1, WordOrder: "little"}, 0x12345678, []uint16{0x5678, 0x1234}},
+		{"uint32 saturates negative", RegisterPoint{Type: "uint32", Scale: 1}, -1, []uint16{0, 0}},
+		{"float32 big endian", RegisterPoint{Type: "float32", Scale: 1}, 3.14159, []uint16{uint16(pi >> 16), uint16(pi)}},
+		{"float32 little endian", RegisterPoint{Type: "float32", Scale: 1, WordOrder: "little"}, 3.14159, []uint16{uint16(pi), uint16(pi >> 16)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodePoint(tt.point, tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("encodePoint(%+v, %v) = %#04x, want %#04x", tt.point, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeString(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		length int
+		want   []uint16
+	}{
+		{"even", "abcd", 2, []uint16{0x6162, 0x6364}},
+		{"odd pads the low byte", "abc", 2, []uint16{0x6162, 0x6300}},
+		{"short pads with zeros", "a", 3, []uint16{0x6100, 0, 0}},
+		{"long is cut off", "abcdef", 2, []uint16{0x6162, 0x6364}},
+		{"empty", "", 1, []uint16{0}},
+		{"no registers", "abc", 0, []uint16{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeString(tt.value, tt.length); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("encodeString(%q, %d) = %#04x, want %#04x", tt.value, tt.length, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterWidth(t *testing.T) {
+	tests := []struct {
+		point RegisterPoint
+		want  int
+	}{
+		{RegisterPoint{Type: "int16"}, 1},
+		{RegisterPoint{Type: "uint16"}, 1},
+		{RegisterPoint{Type: "int32"}, 2},
+		{RegisterPoint{Type: "uint32"}, 2},
+		{RegisterPoint{Type: "float32"}, 2},
+		{RegisterPoint{Type: "string", Length: 16}, 16},
+		{RegisterPoint{Type: "string"}, 0},
+		{RegisterPoint{Type: "string", Length: -1}, 0},
+		{RegisterPoint{Type: "float64"}, 0},
+	}
+	for _, tt := range tests {
+		if got := registerWidth(tt.point); got != tt.want {
+			t.Errorf("registerWidth(%+v) = %d, want %d", tt.point, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterWrites(t *testing.T) {
+	tokens := &honeytokenSet{byDevice: map[string]map[string]*Honeytoken{
+		"PLC-01": {tokenAPIKey: {Kind: tokenAPIKey, Device: "PLC-01", Value: "ak_1"}},
+	}}
+	running.Store(&snapshot{honeytokens: tokens})
+	t.Cleanup(func() { running.Store(nil) })
+
+	data := OTData{
+		DeviceID:  "PLC-01",
+		Timestamp: time.Unix(0x12345678, 0),
+		Status:    "Running",
+		AlarmCode: 500,
+		Metrics:   map[string]float64{"temperature": 21.5, "pressure": 1.25},
+	}
+	tests := []struct {
+		name      string
+		registers []RegisterPoint
+		want      []registerWrite
+	}{
+		{
+			name: "adjacent points merge into one write",
+			registers: []RegisterPoint{
+				{Name: "timestamp", Address: 0, Type: "uint32", Scale: 1},
+				{Name: "temperature", Address: 2, Type: "int16", Scale: 10},
+				{Name: "pressure", Address: 3, Type: "uint16", Scale: 100},
+			},
+			want: []registerWrite{{0, []uint16{0x1234, 0x5678, 215, 125}}},
+		},
+		{
+			name: "state code and alarm code",
+			registers: []RegisterPoint{
+				{Name: "state", Address: 4, Type: "uint16", Scale: 1},
+				{Name: "alarm_code", Address: 5, Type: "uint16", Scale: 1},
+			},
+			want: []registerWrite{{4, []uint16{2, 500}}},
+		},
+		{
+			name: "gaps split the writes, in address order",
+			registers: []RegisterPoint{
+				{Name: "pressure", Address: 20, Type: "uint16", Scale: 100},
+				{Name: "temperature", Address: 10, Type: "int16", Scale: 10},
+			},
+			want: []registerWrite{{10, []uint16{215}}, {20, []uint16{125}}},
+		},
+		{
+			name: "metrics the reading lacks are left out",
+			registers: []RegisterPoint{
+				{Name: "flow_rate", Address: 0, Type: "uint16", Scale: 1},
+				{Name: "pressure", Address: 1, Type: "uint16", Scale: 1},
+			},
+			want: []registerWrite{{1, []uint16{1}}},
+		},
+		{
+			name: "strings carry the honeytoken of the device",
+			registers: []RegisterPoint{
+				{Name: tokenAPIKey, Address: 5, Type: "string", Length: 3},
+			},
+			want: []registerWrite{{5, []uint16{0x616B, 0x5F31, 0}}},
+		},
+		{
+			name: "strings without a token are left out",
+			registers: []RegisterPoint{
+				{Name: "serial", Address: 5, Type: "string", Length: 3},
+			},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &RegisterMap{UnitID: 1, Registers: tt.registers}
+			if got := m.registerWrites(data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("registerWrites() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterWritesSplitsLongRuns(t *testing.T) {
+	running.Store(&snapshot{honeytokens: &honeytokenSet{}})
+	t.Cleanup(func() { running.Store(nil) })
+
+	// 63 timestamps in a row take 126 registers, three more than one request carries
+	m := &RegisterMap{UnitID: 1}
+	for i := 0; i < 63; i++ {
+		m.Registers = append(m.Registers, RegisterPoint{Name: "timestamp", Address: uint16(2 * i), Type: "uint32", Scale: 1})
+	}
+
+	writes := m.registerWrites(OTData{Timestamp: time.Unix(1, 0)})
+	if len(writes) != 2 {
+		t.Fatalf("registerWrites() made %d writes, want 2", len(writes))
+	}
+	if len(writes[0].words) != maxWriteRegisters || writes[1].address != maxWriteRegisters || len(writes[1].words) != 3 {
+		t.Errorf("registerWrites() split into %d at %d and %d at %d, want %d at 0 and 3 at %d",
+			len(writes[0].words), writes[0].address, len(writes[1].words), writes[1].address, maxWriteRegisters, maxWriteRegisters)
+	}
+}
+
+func TestCheckOverlaps(t *testing.T) {
+	tests := []struct {
+		name string
+		maps map[string]*RegisterMap
+		want string // part of the error, empty when the maps fit
+	}{
+		{
+			name: "separate blocks",
+			maps: map[string]*RegisterMap{
+				"A": {UnitID: 1, Registers: []RegisterPoint{{Name: "t", Address: 0, Type: "uint32"}}},
+				"B": {UnitID: 1, Registers: []RegisterPoint{{Name: "t", Address: 2, Type: "uint32"}}},
+			},
+		},
+		{
+			name: "same addresses on different units",
+			maps: map[string]*RegisterMap{
+				"A": {UnitID: 1, Registers: []RegisterPoint{{Name: "t", Address: 0, Type: "uint32"}}},
+				"B": {UnitID: 2, Registers: []RegisterPoint{{Name: "t", Address: 0, Type: "uint32"}}},
+			},
+		},
+		{
+			name: "registers and coils have their own addresses",
+			maps: map[string]*RegisterMap{
+				"A": {UnitID: 1, Registers: []RegisterPoint{{Name: "t", Address: 0, Type: "uint16"}}, Coils: []CoilPoint{{Name: "run", Address: 0}}},
+			},
+		},
+		{
+			name: "second word of a 32-bit point",
+			maps: map[string]*RegisterMap{
+				"A": {UnitID: 1, Registers: []RegisterPoint{{Name: "t", Address: 0, Type: "float32"}}},
+				"B": {UnitID: 1, Registers: []RegisterPoint{{Name: "p", Address: 1, Type: "uint16"}}},
+			},
+			want: "A t and B p both use address 1 on unit 1",
+		},
+		{
+			name: "string reaching into the next point",
+			maps: map[string]*RegisterMap{
+				"A": {UnitID: 1, Registers: []RegisterPoint{
+					{Name: "api_key", Address: 10, Type: "string", Length: 16},
+					{Name: "state", Address: 25, Type: "uint16"},
+				}},
+			},
+			want: "A api_key and A state both use address 25 on unit 1",
+		},
+		{
+			name: "coils",
+			maps: map[string]*RegisterMap{
+				"A": {UnitID: 3, Coils: []CoilPoint{{Name: "run", Address: 7}}},
+				"B": {UnitID: 3, Coils: []CoilPoint{{Name: "fault", Address: 7}}},
+			},
+			want: "A run and B fault both use address 7 on unit 3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOverlaps(tt.maps)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("checkOverlaps() = %v, want no error", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("checkOverlaps() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRegisterMaps(t *testing.T) {
+	types, err := loadCatalogue(nil)
+	if err != nil {
+		t.Fatalf("loadCatalogue() = %v", err)
+	}
+	f, err := newFleet([]DeviceConfig{
+		{ID: "Flow-01", Type: "Flow", Protocols: []string{"modbus"}},
+		{ID: "TH-01", Type: "TempHumidity", Protocols: []string{"mqtt"}},
+		{ID: "Power-01", Type: "Power", Protocols: []string{"mqtt", "modbus"}},
+	}, nil, types)
+	if err != nil {
+		t.Fatalf("newFleet() = %v", err)
+	}
+	writeMap := func(content string) string {
+		path := filepath.Join(t.TempDir(), "registers.json")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("defaults on a unit per device", func(t *testing.T) {
+		maps, err := loadRegisterMaps("", f, &honeytokenSet{})
+		if err != nil {
+			t.Fatalf("loadRegisterMaps() = %v", err)
+		}
+		if len(maps) != 2 || maps["Flow-01"].UnitID != 1 || maps["Power-01"].UnitID != 2 {
+			t.Errorf("loadRegisterMaps() = %v, want Flow-01 on unit 1 and Power-01 on unit 2", maps)
+		}
+		if p := maps["Power-01"].Registers[0]; p.Name != "timestamp" || p.Address != 0 {
+			t.Errorf("first register of Power-01 = %+v, want the timestamp at 0", p)
+		}
+	})
+
+	t.Run("every Modbus device from the file", func(t *testing.T) {
+		path := writeMap(`{
+			"Flow-01": {"unit_id": 1, "registers": [{"name": "flow_rate", "address": 0, "type": "uint16"}]},
+			"Power-01": {"unit_id": 2, "registers": [{"name": "power_consumption", "address": 0, "type": "uint16"}]}
+		}`)
+		maps, err := loadRegisterMaps(path, f, &honeytokenSet{})
+		if err != nil {
+			t.Fatalf("loadRegisterMaps() = %v", err)
+		}
+		if p := maps["Power-01"].Registers[0]; p.Name != "power_consumption" || p.Scale != 1 {
+			t.Errorf("first register of Power-01 = %+v, want power_consumption with scale 1", p)
+		}
+	})
+
+	t.Run("Modbus device missing from the file", func(t *testing.T) {
+		path := writeMap(`{"Flow-01": {"unit_id": 1, "registers": [{"name": "flow_rate", "address": 0, "type": "uint16"}]}}`)
+		_, err := loadRegisterMaps(path, f, &honeytokenSet{})
+		if err == nil || !strings.Contains(err.Error(), "no layout for Modbus device Power-01") {
+			t.Errorf("loadRegisterMaps() = %v, want Power-01 reported missing", err)
+		}
+	})
+}
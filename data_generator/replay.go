@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayConfig points the generator at a historian export to replay instead of the models
+type ReplayConfig struct {
+	File   string               `json:"file"`   // CSV or JSONL with timestamp, tag and value
+	Format string               `json:"format"` // csv or jsonl, taken from the file extension when empty
+	Speed  float64              `json:"speed"`  // 1 is real time, 60 plays an hour per minute
+	Loop   bool                 `json:"loop"`   // start over at the end instead of falling back to the models
+	Tags   map[string]ReplayTag `json:"tags"`   // historian tag -> device metric
+}
+
+// ReplayTag is the device metric a historian tag is replayed on
+type ReplayTag struct {
+	Device string `json:"device"`
+	Metric string `json:"metric"`
+}
+
+// replayPoint is one recorded value of a tag
+type replayPoint struct {
+	at    time.Time
+	value float64
+}
+
+// Replay plays recorded values back on the fleet. The recording is mapped onto
+// the time since the replay started, so readings keep current timestamps while
+// the values follow the recording.
+type Replay struct {
+	file        string
+	from        time.Time // when the replay started
+	speed       float64
+	loop        bool
+	first, last time.Time                           // span of the recording
+	series      map[string]map[string][]replayPoint // device -> metric -> points in time order
+	finished    sync.Once
+}
+
+// loadReplay reads a historian export and maps its tags onto the fleet, the
+// replay starts at start. Without a file there is nothing to replay.
+func loadReplay(c ReplayConfig, f *Fleet, start time.Time) (*Replay, error) {
+	if c.File == "" {
+		return nil, nil
+	}
+	for tag, t := range c.Tags {
+		d, ok := f.byID[t.Device]
+		if !ok {
+			return nil, fmt.Errorf("replay tag %s maps to unknown device %q", tag, t.Device)
+		}
+		if !d.Reports(t.Metric) {
+			return nil, fmt.Errorf("replay tag %s maps to %q, which %s does not report", tag, t.Metric, d.ID)
+		}
+	}
+
+	file, err := os.Open(c.File)
+	if err != nil {
+		return nil, fmt.Errorf("could not read replay file: %v", err)
+	}
+	defer file.Close()
+
+	format := c.Format
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(c.File)), ".")
+	}
+	var records []historianRecord
+	switch format {
+	case "csv":
+		records, err = readHistorianCSV(file)
+	case "jsonl", "json":
+		records, err = readHistorianJSONL(file)
+	default:
+		return nil, fmt.Errorf("unknown replay format %q, use csv or jsonl", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse replay file %s: %v", c.File, err)
+	}
+
+	r := &Replay{
+		file:   c.File,
+		from:   start,
+		speed:  c.Speed,
+		loop:   c.Loop,
+		series: make(map[string]map[string][]replayPoint),
+	}
+	unmapped := make(map[string]bool)
+	for _, rec := range records {
+		t, ok := c.Tags[rec.tag]
+		if !ok {
+			unmapped[rec.tag] = true
+			continue
+		}
+		if r.series[t.Device] == nil {
+			r.series[t.Device] = make(map[string][]replayPoint)
+		}
+		r.series[t.Device][t.Metric] = append(r.series[t.Device][t.Metric], replayPoint{rec.at, rec.value})
+		if r.first.IsZero() || rec.at.Before(r.first) {
+			r.first = rec.at
+		}
+		if rec.at.After(r.last) {
+			r.last = rec.at
+		}
+	}
+	if len(r.series) == 0 {
+		return nil, fmt.Errorf("replay file %s has no values for the configured tags", c.File)
+	}
+	for _, metrics := range r.series {
+		for _, points := range metrics {
+			sort.SliceStable(points, func(i, j int) bool { return points[i].at.Before(points[j].at) })
+		}
+	}
+	if len(unmapped) > 0 {
+		log.Printf("Replay of %s ignores %d tags without a device", c.File, len(unmapped))
+	}
+	log.Printf("Replaying %s (%s to %s) at %gx", c.File, r.first.Format(time.RFC3339), r.last.Format(time.RFC3339), r.speed)
+	return r, nil
+}
+
+// position returns the recorded time that plays at now, false once a replay without loop is over
+func (r *Replay) position(now time.Time) (time.Time, bool) {
+	elapsed := time.Duration(float64(now.Sub(r.from)) * r.speed)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	span := r.last.Sub(r.first)
+	if elapsed > span {
+		if !r.loop {
+			r.finished.Do(func() { log.Printf("Replay of %s finished, back to the models", r.file) })
+			return time.Time{}, false
+		}
+		if span > 0 {
+			elapsed %= span
+		} else {
+			elapsed = 0
+		}
+	}
+	return r.first.Add(elapsed), true
+}
+
+// Value returns the recorded value of a device metric at now, the last value
+// recorded before that moment. It is safe to call on a nil Replay.
+func (r *Replay) Value(deviceID, metric string, now time.Time) (float64, bool) {
+	if r == nil {
+		return 0, false
+	}
+	points := r.series[deviceID][metric]
+	if len(points) == 0 {
+		return 0, false
+	}
+	at, ok := r.position(now)
+	if !ok {
+		return 0, false
+	}
+
+	i := sort.Search(len(points), func(i int) bool { return points[i].at.After(at) })
+	if i == 0 {
+		// Before the first value of this tag, a loop still holds the end of the previous pass
+		if !r.loop {
+			return 0, false
+		}
+		i = len(points)
+	}
+	return points[i-1].value, true
+}
+
+// historianRecord is one row of a historian export
+type historianRecord struct {
+	at    time.Time
+	tag   string
+	value float64
+}
+
+// readHistorianCSV reads a CSV export with a header naming the timestamp, tag and value columns
+func readHistorianCSV(r io.Reader) ([]historianRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header: %v", err)
+	}
+	columns := map[string]int{"timestamp": -1, "tag": -1, "value": -1}
+	for i, name := range header {
+		if _, ok := columns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+	}
+	for name, i := range columns {
+		if i < 0 {
+			return nil, fmt.Errorf("header has no %s column", name)
+		}
+	}
+
+	var records []historianRecord
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(column string) string {
+			if i := columns[column]; i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		rec, err := parseHistorianRecord(get("timestamp"), get("tag"), get("value"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// readHistorianJSONL reads one {"timestamp": ..., "tag": ..., "value": ...} object per line
+func readHistorianJSONL(r io.Reader) ([]historianRecord, error) {
+	var records []historianRecord
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var row struct {
+			Timestamp json.RawMessage `json:"timestamp"`
+			Tag       string          `json:"tag"`
+			Value     json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		// Timestamps and values may be quoted or not
+		rec, err := parseHistorianRecord(strings.Trim(string(row.Timestamp), `"`), row.Tag, strings.Trim(string(row.Value), `"`))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+func parseHistorianRecord(timestamp, tag, value string) (historianRecord, error) {
+	if tag == "" {
+		return historianRecord{}, fmt.Errorf("missing tag")
+	}
+	at, err := parseHistorianTime(timestamp)
+	if err != nil {
+		return historianRecord{}, err
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return historianRecord{}, fmt.Errorf("tag %s has invalid value %q", tag, value)
+	}
+	return historianRecord{at: at, tag: tag, value: v}, nil
+}
+
+// historianTimeLayouts are the timestamp layouts historians commonly export
+var historianTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006/01/02 15:04:05",
+	"01/02/2006 15:04:05",
+}
+
+// parseHistorianTime parses a timestamp in one of historianTimeLayouts or as Unix seconds or milliseconds
+func parseHistorianTime(s string) (time.Time, error) {
+	for _, layout := range historianTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		// 1e12 seconds is tens of thousands of years away, such numbers are milliseconds
+		if n > 1e12 {
+			return time.UnixMilli(int64(n)).UTC(), nil
+		}
+		return time.Unix(0, int64(n*float64(time.Second))).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
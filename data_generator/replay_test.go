@@ -0,0 +1,214 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistorianTime(t *testing.T) {
+	want := time.Date(2024, 3, 12, 6, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2024-03-12T06:00:00Z", want, false},
+		{"2024-03-12T07:00:00+01:00", want, false},
+		{"2024-03-12 06:00:00", want, false},
+		{"2024-03-12 06:00:00.250", want.Add(250 * time.Millisecond), false},
+		{"2024-03-12T06:00:00", want, false},
+		{"2024/03/12 06:00:00", want, false},
+		{"03/12/2024 06:00:00", want, false},
+		{"1710223200", want, false},
+		{"1710223200.5", want.Add(500 * time.Millisecond), false},
+		{"1710223200000", want, false},
+		{"", time.Time{}, true},
+		{"12 March", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHistorianTime(tt.in)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("parseHistorianTime(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadHistorian(t *testing.T) {
+	tests := []struct {
+		name    string
+		read    func(string) ([]historianRecord, error)
+		in      string
+		want    []historianRecord
+		wantErr string
+	}{
+		{
+			name: "csv",
+			read: func(s string) ([]historianRecord, error) { return readHistorianCSV(strings.NewReader(s)) },
+			in:   "timestamp,tag,value\n1710223200,FIC101,180.5\n1710223260,TT201,62\n",
+			want: []historianRecord{{time.Unix(1710223200, 0), "FIC101", 180.5}, {time.Unix(1710223260, 0), "TT201", 62}},
+		},
+		{
+			name: "csv columns in any order and case",
+			read: func(s string) ([]historianRecord, error) { return readHistorianCSV(strings.NewReader(s)) },
+			in:   "Quality, Value ,TAG,Timestamp\ngood,1.5,FIC101,1710223200\n",
+			want: []historianRecord{{time.Unix(1710223200, 0), "FIC101", 1.5}},
+		},
+		{
+			name:    "csv without value column",
+			read:    func(s string) ([]historianRecord, error) { return readHistorianCSV(strings.NewReader(s)) },
+			in:      "timestamp,tag\n1710223200,FIC101\n",
+			wantErr: "header has no value column",
+		},
+		{
+			name:    "csv with a bad value",
+			read:    func(s string) ([]historianRecord, error) { return readHistorianCSV(strings.NewReader(s)) },
+			in:      "timestamp,tag,value\n1710223200,FIC101,1\n1710223260,FIC101,bad\n",
+			wantErr: `line 3: tag FIC101 has invalid value "bad"`,
+		},
+		{
+			name: "jsonl quoted and unquoted, blank lines skipped",
+			read: func(s string) ([]historianRecord, error) { return readHistorianJSONL(strings.NewReader(s)) },
+			in:   `{"timestamp": 1710223200, "tag": "FIC101", "value": 180.5}` + "\n\n" + `{"timestamp": "2024-03-12T06:01:00Z", "tag": "TT201", "value": "62"}` + "\n",
+			want: []historianRecord{{time.Unix(1710223200, 0), "FIC101", 180.5}, {time.Unix(1710223260, 0), "TT201", 62}},
+		},
+		{
+			name:    "jsonl without tag",
+			read:    func(s string) ([]historianRecord, error) { return readHistorianJSONL(strings.NewReader(s)) },
+			in:      `{"timestamp": 1710223200, "value": 1}` + "\n",
+			wantErr: "line 1: missing tag",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.read(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("read = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(got) != len(tt.want) {
+				t.Fatalf("read = %v, %v, want %v", got, err, tt.want)
+			}
+			for i := range got {
+				if !got[i].at.Equal(tt.want[i].at) || got[i].tag != tt.want[i].tag || got[i].value != tt.want[i].value {
+					t.Errorf("record %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// replayFleet is the fleet the replay tests map their tags onto
+func replayFleet(t *testing.T) *Fleet {
+	t.Helper()
+	types, err := loadCatalogue(nil)
+	if err != nil {
+		t.Fatalf("loadCatalogue() = %v", err)
+	}
+	f, err := newFleet([]DeviceConfig{{ID: "Flow-01", Type: "Flow"}, {ID: "TH-01", Type: "TempHumidity"}}, nil, types)
+	if err != nil {
+		t.Fatalf("newFleet() = %v", err)
+	}
+	return f
+}
+
+// writeHistorian writes a historian export to a temporary file
+func writeHistorian(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadReplay(t *testing.T) {
+	f := replayFleet(t)
+	csv := writeHistorian(t, "historian.csv", "timestamp,tag,value\n1710223200,FIC101,180\n1710223200,OTHER,1\n")
+	tags := map[string]ReplayTag{"FIC101": {Device: "Flow-01", Metric: "flow_rate"}}
+	tests := []struct {
+		name    string
+		config  ReplayConfig
+		wantErr string // part of the error, empty when the replay loads
+	}{
+		{"no file", ReplayConfig{}, ""},
+		{"csv", ReplayConfig{File: csv, Speed: 1, Tags: tags}, ""},
+		{"unknown device", ReplayConfig{File: csv, Tags: map[string]ReplayTag{"FIC101": {Device: "Flow-09", Metric: "flow_rate"}}}, `unknown device "Flow-09"`},
+		{"metric the device does not report", ReplayConfig{File: csv, Tags: map[string]ReplayTag{"FIC101": {Device: "Flow-01", Metric: "humidity"}}}, "which Flow-01 does not report"},
+		{"no values for the tags", ReplayConfig{File: csv, Tags: map[string]ReplayTag{"TT201": {Device: "TH-01", Metric: "temperature"}}}, "no values for the configured tags"},
+		{"unknown format", ReplayConfig{File: csv, Format: "xml", Tags: tags}, `unknown replay format "xml"`},
+		{"missing file", ReplayConfig{File: csv + ".missing", Tags: tags}, "could not read replay file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := loadReplay(tt.config, f, time.Now())
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("loadReplay() = %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("loadReplay() = %v, want %q", err, tt.wantErr)
+			case tt.config.File == "" && r != nil:
+				t.Errorf("loadReplay() without a file = %+v, want nil", r)
+			}
+		})
+	}
+}
+
+func TestReplayValue(t *testing.T) {
+	// Flow is recorded every two minutes from 06:00 to 06:04, temperature once at 06:01
+	path := writeHistorian(t, "historian.csv", `timestamp,tag,value
+2024-03-12T06:00:00Z,FIC101,10
+2024-03-12T06:02:00Z,FIC101,20
+2024-03-12T06:04:00Z,FIC101,30
+2024-03-12T06:01:00Z,TT201,62
+`)
+	tags := map[string]ReplayTag{
+		"FIC101": {Device: "Flow-01", Metric: "flow_rate"},
+		"TT201":  {Device: "TH-01", Metric: "temperature"},
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		speed  float64
+		loop   bool
+		device string
+		metric string
+		at     time.Duration // since the replay started
+		want   float64
+		wantOK bool
+	}{
+		{"before the start", 1, false, "Flow-01", "flow_rate", -time.Minute, 10, true},
+		{"first value", 1, false, "Flow-01", "flow_rate", 0, 10, true},
+		{"held until the next", 1, false, "Flow-01", "flow_rate", 119 * time.Second, 10, true},
+		{"next value", 1, false, "Flow-01", "flow_rate", 2 * time.Minute, 20, true},
+		{"last value", 1, false, "Flow-01", "flow_rate", 4 * time.Minute, 30, true},
+		{"finished without loop", 1, false, "Flow-01", "flow_rate", 4*time.Minute + time.Second, 0, false},
+		{"faster", 60, false, "Flow-01", "flow_rate", 2 * time.Second, 20, true},
+		{"loop starts over", 1, true, "Flow-01", "flow_rate", 5 * time.Minute, 10, true},
+		{"loop second pass", 1, true, "Flow-01", "flow_rate", 6 * time.Minute, 20, true},
+		{"tag not recorded yet", 1, false, "TH-01", "temperature", 30 * time.Second, 0, false},
+		{"loop holds the previous pass", 1, true, "TH-01", "temperature", 30 * time.Second, 62, true},
+		{"metric without tag", 1, false, "TH-01", "humidity", time.Minute, 0, false},
+		{"device without tags", 1, false, "Power-01", "power_consumption", time.Minute, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := loadReplay(ReplayConfig{File: path, Speed: tt.speed, Loop: tt.loop, Tags: tags}, replayFleet(t), start)
+			if err != nil {
+				t.Fatalf("loadReplay() = %v", err)
+			}
+			if got, ok := r.Value(tt.device, tt.metric, start.Add(tt.at)); got != tt.want || ok != tt.wantOK {
+				t.Errorf("Value() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	var none *Replay
+	if _, ok := none.Value("Flow-01", "flow_rate", start); ok {
+		t.Error("a nil replay returned a value")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ScenarioConfig is one fault or anomaly in the scenario file
+type ScenarioConfig struct {
+	Name       string  `json:"name"`
+	Device     string  `json:"device"`
+	Kind       string  `json:"kind"`        // drift, stuck, spike, offline, maintenance, fault, alarm_flood or pump_failure
+	Metric     string  `json:"metric"`      // empty for every metric of the device
+	Start      string  `json:"start"`       // RFC 3339 time, or a delay after start-up such as "10m"
+	Duration   string  `json:"duration"`    // how long the scenario lasts, such as "30m"
+	Magnitude  float64 `json:"magnitude"`   // offset reached at the end of a drift, or the size of a spike
+	IntervalMs int     `json:"interval_ms"` // publish interval during an alarm flood
+	Code       int     `json:"code"`        // alarm code of a fault
+}
+
+// Scenario is a scheduled ScenarioConfig with its run-time state
+type Scenario struct {
+	ScenarioConfig
+	From  time.Time
+	Until time.Time
+
+	started bool
+	ended   bool
+	frozen  map[string]float64
+	flaps   int
+}
+
+// ScenarioSchedule holds every scenario, past, running and upcoming
+type ScenarioSchedule struct {
+	mu        sync.Mutex
+	scenarios []*Scenario
+}
+
+// defaultFloodInterval is how fast a device publishes during an alarm flood without interval_ms
+const defaultFloodInterval = 250 * time.Millisecond
+
+// Alarm codes raised by scenarios, a fault without code raises faultAlarm
+const (
+	floodAlarm       = 900
+	pumpFailureAlarm = 910
+	faultAlarm       = 990
+)
+
+// scenarioEffects is what the scenarios running on a device do to it besides changing its values
+type scenarioEffects struct {
+	maintenance bool
+	alarms      []alarmCondition
+}
+
+// loadScenarios reads a scenario file into a new schedule for a fleet, relative to start
+func loadScenarios(path string, f *Fleet, start time.Time) (*ScenarioSchedule, error) {
+	schedule := &ScenarioSchedule{}
+	if path == "" {
+		return schedule, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read scenario file: %v", err)
+	}
+
+	var configs []ScenarioConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("could not parse scenario file: %v", err)
+	}
+
+	for _, c := range configs {
+		if _, err := schedule.Add(c, f, start); err != nil {
+			return nil, err
+		}
+	}
+	return schedule, nil
+}
+
+// Add validates a scenario against a fleet and schedules it. A relative start is counted from base.
+func (s *ScenarioSchedule) Add(c ScenarioConfig, f *Fleet, base time.Time) (*Scenario, error) {
+	if c.Name == "" {
+		c.Name = c.Kind
+	}
+	if _, ok := f.byID[c.Device]; !ok {
+		return nil, fmt.Errorf("scenario %s targets unknown device %q", c.Name, c.Device)
+	}
+	switch c.Kind {
+	case "drift", "spike":
+		if c.Magnitude == 0 {
+			return nil, fmt.Errorf("scenario %s needs a magnitude", c.Name)
+		}
+	case "stuck", "offline", "maintenance", "fault", "alarm_flood", "pump_failure":
+	default:
+		return nil, fmt.Errorf("scenario %s has unknown kind %q", c.Name, c.Kind)
+	}
+
+	from := base
+	if c.Start != "" {
+		if at, err := time.Parse(time.RFC3339, c.Start); err == nil {
+			from = at
+		} else if delay, err := time.ParseDuration(c.Start); err == nil {
+			from = base.Add(delay)
+		} else {
+			return nil, fmt.Errorf("scenario %s has invalid start %q", c.Name, c.Start)
+		}
+	}
+	duration, err := time.ParseDuration(c.Duration)
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("scenario %s has invalid duration %q", c.Name, c.Duration)
+	}
+
+	scenario := &Scenario{ScenarioConfig: c, From: from, Until: from.Add(duration)}
+	s.mu.Lock()
+	s.scenarios = append(s.scenarios, scenario)
+	s.mu.Unlock()
+	return scenario, nil
+}
+
+// scenarioView is the JSON representation of a scenario in the API
+type scenarioView struct {
+	ScenarioConfig
+	From   time.Time `json:"from"`
+	Until  time.Time `json:"until"`
+	Active bool      `json:"active"`
+}
+
+// view only reads what is fixed when the scenario is added, so it needs no lock
+func (sc *Scenario) view() scenarioView {
+	now := time.Now()
+	return scenarioView{
+		ScenarioConfig: sc.ScenarioConfig,
+		From:           sc.From,
+		Until:          sc.Until,
+		Active:         !now.Before(sc.From) && now.Before(sc.Until),
+	}
+}
+
+// List returns every scheduled scenario
+func (s *ScenarioSchedule) List() []scenarioView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	views := make([]scenarioView, 0, len(s.scenarios))
+	for _, sc := range s.scenarios {
+		views = append(views, sc.view())
+	}
+	return views
+}
+
+// active returns the scenarios running on a device at now, s.mu must be held
+func (s *ScenarioSchedule) active(deviceID string, now time.Time) []*Scenario {
+	var running []*Scenario
+	for _, sc := range s.scenarios {
+		if sc.Device != deviceID {
+			continue
+		}
+		if now.Before(sc.From) {
+			continue
+		}
+		if !now.Before(sc.Until) {
+			if sc.started && !sc.ended {
+				sc.ended = true
+				log.Printf("Scenario %s (%s) ended on %s", sc.Name, sc.Kind, sc.Device)
+			}
+			continue
+		}
+		if !sc.started {
+			sc.started = true
+			log.Printf("Scenario %s (%s) started on %s until %s", sc.Name, sc.Kind, sc.Device, sc.Until.Format(time.RFC3339))
+		}
+		running = append(running, sc)
+	}
+	return running
+}
+
+// Offline reports whether a device is taken offline by a scenario
+func (s *ScenarioSchedule) Offline(deviceID string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sc := range s.active(deviceID, now) {
+		if sc.Kind == "offline" {
+			return true
+		}
+	}
+	return false
+}
+
+// Interval returns the publish interval of a device, shortened during an alarm flood
+func (s *ScenarioSchedule) Interval(deviceID string, now time.Time, interval time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sc := range s.active(deviceID, now) {
+		if sc.Kind != "alarm_flood" {
+			continue
+		}
+		flood := time.Duration(sc.IntervalMs) * time.Millisecond
+		if flood <= 0 {
+			flood = defaultFloodInterval
+		}
+		if flood < interval {
+			interval = flood
+		}
+	}
+	return interval
+}
+
+// Apply alters a fresh reading according to the scenarios running on its device
+// and returns the maintenance and alarms they put the device in
+func (s *ScenarioSchedule) Apply(data *OTData) scenarioEffects {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var effects scenarioEffects
+	for _, sc := range s.active(data.DeviceID, data.Timestamp) {
+		progress := float64(data.Timestamp.Sub(sc.From)) / float64(sc.Until.Sub(sc.From))
+		for name, value := range data.Metrics {
+			if sc.Metric != "" && sc.Metric != name {
+				continue
+			}
+			switch sc.Kind {
+			case "drift":
+				value = round(value+sc.Magnitude*progress, 2)
+			case "spike":
+				value = round(value+sc.Magnitude, 2)
+			case "stuck":
+				if sc.frozen == nil {
+					sc.frozen = make(map[string]float64)
+				}
+				if frozen, ok := sc.frozen[name]; ok {
+					value = frozen
+				} else {
+					sc.frozen[name] = value
+				}
+			case "pump_failure":
+				value = round(pumpFailure(name, value, progress), 2)
+			}
+			data.Metrics[name] = value
+		}
+
+		switch sc.Kind {
+		case "maintenance":
+			effects.maintenance = true
+		case "fault":
+			code := sc.Code
+			if code == 0 {
+				code = faultAlarm
+			}
+			effects.alarms = append(effects.alarms, alarmCondition{code, sc.Name, fmt.Sprintf("Fault %d from scenario %s", code, sc.Name)})
+		case "alarm_flood":
+			// A flapping alarm is what floods an operator console
+			sc.flaps++
+			if sc.flaps%2 == 1 {
+				effects.alarms = append(effects.alarms, alarmCondition{floodAlarm, sc.Name, "Alarm chattering"})
+			}
+		case "pump_failure":
+			if progress > 0.9 {
+				effects.alarms = append(effects.alarms, alarmCondition{pumpFailureAlarm, sc.Name, "Pump tripped"})
+			}
+		}
+	}
+	return effects
+}
+
+// pumpFailure degrades a metric as a pump wears out: flow falls while vibration, power and temperature climb
+func pumpFailure(metric string, value, progress float64) float64 {
+	switch metric {
+	case "flow_rate":
+		return value * (1 - 0.6*progress)
+	case "vibration":
+		return value + 1.5*progress
+	case "power_consumption":
+		return value * (1 + 0.3*progress)
+	case "temperature":
+		return value + 20*progress
+	}
+	return value
+}
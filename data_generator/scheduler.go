@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultServiceInterval matches the interval the HTML page polls /generate with
+const defaultServiceInterval = time.Second
+
+// Scheduler runs data generation for services in the background, independent of the HTML page
+type Scheduler struct {
+	mu        sync.Mutex
+	running   map[string]context.CancelFunc
+	intervals map[string]time.Duration
+}
+
+var scheduler = &Scheduler{
+	running:   make(map[string]context.CancelFunc),
+	intervals: make(map[string]time.Duration),
+}
+
+// Start generates data for a service every interval until it is stopped, restarting it if it already runs
+func (s *Scheduler) Start(service string, interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cancel, ok := s.running[service]; ok {
+		cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.running[service] = cancel
+	s.intervals[service] = interval
+
+	log.Printf("Generating %s data every %s", service, interval)
+	go s.run(ctx, service, interval)
+}
+
+// Stop stops generating data for a service
+func (s *Scheduler) Stop(service string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cancel, ok := s.running[service]; ok {
+		cancel()
+		delete(s.running, service)
+		log.Printf("Stopped generating %s data", service)
+	}
+}
+
+// SetInterval changes the generation interval of a service, restarting it when it runs
+func (s *Scheduler) SetInterval(service string, interval time.Duration) {
+	s.mu.Lock()
+	_, running := s.running[service]
+	s.intervals[service] = interval
+	s.mu.Unlock()
+
+	if running {
+		s.Start(service, interval)
+	}
+}
+
+// Interval returns the generation interval of a service and whether it is running
+func (s *Scheduler) Interval(service string) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, running := s.running[service]
+	if interval, ok := s.intervals[service]; ok {
+		return interval, running
+	}
+	return serviceInterval(service), running
+}
+
+// Running returns the services that are being generated
+func (s *Scheduler) Running() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	services := make([]string, 0, len(s.running))
+	for service := range s.running {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
+
+func (s *Scheduler) run(ctx context.Context, service string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Only log when the outcome changes, a healthy service would otherwise log every tick
+	var previous string
+	for {
+		// A round still running from /generate is simply skipped, the next tick tries again
+		if result := runService(ctx, service); result.Status != statusBusy && result.String() != previous {
+			log.Print(result.String())
+			previous = result.String()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enabledServices returns the services to generate from boot, from the flags and the scheduler config
+func enabledServices(c *Config) []string {
+	enabled := map[string]bool{
+		"mqtt":   *enableMQTT,
+		"modbus": *enableModbus,
+		"coap":   *enableCoAP,
+	}
+	for _, service := range c.Scheduler.Services {
+		enabled[strings.ToLower(service)] = true
+	}
+
+	var services []string
+	for service, on := range enabled {
+		if on {
+			services = append(services, service)
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+// serviceInterval returns the configured generation interval of a service
+func serviceInterval(service string) time.Duration {
+	if ms := current().config.Scheduler.IntervalMs[service]; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultServiceInterval
+}
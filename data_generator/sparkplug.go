@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B metric data types used by the generator
+const (
+	spUInt64  = 8
+	spDouble  = 10
+	spBoolean = 11
+	spString  = 12
+)
+
+// spNamespace is the topic namespace of Sparkplug B
+const spNamespace = "spBv1.0"
+
+// spMetric is one metric of a Sparkplug B payload, value is a uint64, float64, bool or string
+type spMetric struct {
+	name  string
+	value interface{}
+}
+
+// sparkplugPublisher publishes the fleet as the devices of one Sparkplug B edge
+// node. The node has its own MQTT session, so its death certificate can be the
+// Last Will of that session.
+type sparkplugPublisher struct {
+	client  mqtt.Client
+	bdSeq   uint64 // birth/death sequence of the current session
+	next    uint64 // bdSeq of the next session
+	seq     uint64
+	born    map[string]bool
+	rebirth atomic.Bool
+}
+
+func (p *sparkplugPublisher) groupID() string {
+	return current().config.Sparkplug.GroupID
+}
+
+func (p *sparkplugPublisher) edgeNodeID() string {
+	return current().config.Sparkplug.EdgeNodeID
+}
+
+// topic builds spBv1.0/<group>/<type>/<edge node>[/<device>]
+func (p *sparkplugPublisher) topic(messageType, device string) string {
+	topic := fmt.Sprintf("%s/%s/%s/%s", spNamespace, p.groupID(), messageType, p.edgeNodeID())
+	if device != "" {
+		topic += "/" + device
+	}
+	return topic
+}
+
+func (p *sparkplugPublisher) Connect(ctx context.Context) error {
+	p.bdSeq = p.next
+	p.next = (p.next + 1) % 256
+
+	config := current().config
+	opts, err := mqttClientOptions(p.edgeNodeID())
+	if err != nil {
+		return err
+	}
+	// No auto-reconnect: every session needs a new bdSeq, its own Will and births,
+	// so a lost session shows in Health and the next round replaces it by Connect
+	opts.SetAutoReconnect(false)
+	opts.SetCleanSession(true)
+	// The broker announces our death with the bdSeq of this session if we drop off
+	death := encodeSparkplug(time.Now(), nil, []spMetric{{"bdSeq", p.bdSeq}})
+	opts.SetBinaryWill(p.topic("NDEATH", ""), death, 1, false)
+
+	client := mqtt.NewClient(opts)
+	if err := waitToken(ctx, client.Connect()); err != nil {
+		client.Disconnect(0)
+		return fmt.Errorf("failed to connect to MQTT broker on %s:%d: %v", config.MQTT.Address, config.MQTT.Port, err)
+	}
+
+	// Commands are what SCADA hosts, and anyone poking at the broker, send to edge nodes
+	commands := map[string]byte{p.topic("NCMD", ""): 1, p.topic("DCMD", "+"): 1}
+	if err := waitToken(ctx, client.SubscribeMultiple(commands, p.handleCommand)); err != nil {
+		client.Disconnect(250)
+		return fmt.Errorf("failed to subscribe to Sparkplug commands: %v", err)
+	}
+
+	// The node only counts as connected once it is born, so a failed birth is retried by the next round
+	p.client = client
+	if err := p.publishNodeBirth(ctx); err != nil {
+		client.Disconnect(250)
+		p.client = nil
+		return fmt.Errorf("failed to publish node birth: %v", err)
+	}
+	return nil
+}
+
+// publishNodeBirth announces the edge node, every device is born again after it
+func (p *sparkplugPublisher) publishNodeBirth(ctx context.Context) error {
+	p.seq = 0
+	p.born = make(map[string]bool)
+	return p.send(ctx, p.topic("NBIRTH", ""), []spMetric{
+		{"bdSeq", p.bdSeq},
+		{"Node Control/Rebirth", false},
+		{"Node Info/Group", p.groupID()},
+	})
+}
+
+func (p *sparkplugPublisher) Publish(ctx context.Context, device *Device, data OTData) error {
+	if p.rebirth.Swap(false) {
+		if err := p.publishNodeBirth(ctx); err != nil {
+			return err
+		}
+	}
+
+	metrics := sparkplugMetrics(data)
+	if !p.born[device.ID] {
+		birth := append(metrics,
+			spMetric{"Properties/Type", device.Type},
+			spMetric{"Properties/Location", device.Location},
+		)
+		if err := p.send(ctx, p.topic("DBIRTH", device.ID), birth); err != nil {
+			return fmt.Errorf("failed to publish birth of device %s: %v", device.ID, err)
+		}
+		p.born[device.ID] = true
+		return nil
+	}
+
+	if err := p.send(ctx, p.topic("DDATA", device.ID), metrics); err != nil {
+		return fmt.Errorf("failed to publish data for device %s: %v", device.ID, err)
+	}
+	return nil
+}
+
+func (p *sparkplugPublisher) Target(device *Device) string {
+	return p.topic("DDATA", device.ID)
+}
+
+// send publishes a payload with the next sequence number
+func (p *sparkplugPublisher) send(ctx context.Context, topic string, metrics []spMetric) error {
+	seq := p.seq
+	p.seq = (p.seq + 1) % 256
+
+	return waitToken(ctx, p.client.Publish(topic, 0, false, encodeSparkplug(time.Now(), &seq, metrics)))
+}
+
+// Close buries every device and the node before disconnecting, as a clean shutdown should
+func (p *sparkplugPublisher) Close() error {
+	if p.client == nil {
+		return nil
+	}
+	if p.client.IsConnectionOpen() {
+		for id := range p.born {
+			p.send(context.Background(), p.topic("DDEATH", id), nil)
+		}
+		death := encodeSparkplug(time.Now(), nil, []spMetric{{"bdSeq", p.bdSeq}})
+		p.client.Publish(p.topic("NDEATH", ""), 1, false, death).WaitTimeout(time.Second)
+	}
+	p.client.Disconnect(250)
+	p.client = nil
+	return nil
+}
+
+func (p *sparkplugPublisher) Health() error {
+	if p.client == nil {
+		return errNotConnected
+	}
+	if !p.client.IsConnectionOpen() {
+		return fmt.Errorf("connection to MQTT broker lost")
+	}
+	return nil
+}
+
+// handleCommand logs NCMD and DCMD messages and honours rebirth requests
+func (p *sparkplugPublisher) handleCommand(_ mqtt.Client, msg mqtt.Message) {
+	metrics, err := decodeSparkplugMetrics(msg.Payload())
+	if err != nil {
+		log.Printf("Sparkplug command on %s with invalid payload: %v", msg.Topic(), err)
+		return
+	}
+
+	var names []string
+	for _, m := range metrics {
+		names = append(names, fmt.Sprintf("%s=%v", m.name, m.value))
+		if m.name == "Node Control/Rebirth" && m.value == true {
+			p.rebirth.Store(true)
+		}
+	}
+	log.Printf("Sparkplug command on %s: %s", msg.Topic(), strings.Join(names, ","))
+}
+
+// sparkplugMetrics converts a reading into Sparkplug metrics, sorted by name
+func sparkplugMetrics(data OTData) []spMetric {
+	names := make([]string, 0, len(data.Metrics))
+	for name := range data.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]spMetric, 0, len(names)+2)
+	for _, name := range names {
+		metrics = append(metrics, spMetric{name, data.Metrics[name]})
+	}
+	return append(metrics, spMetric{"status", data.Status}, spMetric{"alarm_code", uint64(data.AlarmCode)})
+}
+
+// encodeSparkplug encodes a Sparkplug B Payload message. seq is left out when nil, as in death certificates.
+func encodeSparkplug(timestamp time.Time, seq *uint64, metrics []spMetric) []byte {
+	ms := uint64(timestamp.UnixMilli())
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType) // timestamp
+	b = protowire.AppendVarint(b, ms)
+	for _, m := range metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType) // metrics
+		b = protowire.AppendBytes(b, encodeSparkplugMetric(m, ms))
+	}
+	if seq != nil {
+		b = protowire.AppendTag(b, 3, protowire.VarintType) // seq
+		b = protowire.AppendVarint(b, *seq)
+	}
+	return b
+}
+
+func encodeSparkplugMetric(m spMetric, ms uint64) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType) // name
+	b = protowire.AppendString(b, m.name)
+	b = protowire.AppendTag(b, 3, protowire.VarintType) // timestamp
+	b = protowire.AppendVarint(b, ms)
+
+	switch v := m.value.(type) {
+	case uint64:
+		b = protowire.AppendTag(b, 4, protowire.VarintType) // datatype
+		b = protowire.AppendVarint(b, spUInt64)
+		b = protowire.AppendTag(b, 11, protowire.VarintType) // long_value
+		b = protowire.AppendVarint(b, v)
+	case float64:
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, spDouble)
+		b = protowire.AppendTag(b, 13, protowire.Fixed64Type) // double_value
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, spBoolean)
+		b = protowire.AppendTag(b, 14, protowire.VarintType) // boolean_value
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, spString)
+		b = protowire.AppendTag(b, 15, protowire.BytesType) // string_value
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+// decodeSparkplugMetrics reads the names and scalar values of the metrics in a payload
+func decodeSparkplugMetrics(b []byte) ([]spMetric, error) {
+	var metrics []spMetric
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == 2 && typ == protowire.BytesType {
+			raw, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			m, err := decodeSparkplugMetric(raw)
+			if err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, m)
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return metrics, nil
+}
+
+func decodeSparkplugMetric(b []byte) (spMetric, error) {
+	var m spMetric
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.name, n = protowire.ConsumeString(b)
+		case (num == 10 || num == 11) && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			m.value = v
+		case num == 12 && typ == protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			m.value = float64(math.Float32frombits(v))
+		case num == 13 && typ == protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(b)
+			m.value = math.Float64frombits(v)
+		case num == 14 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			m.value = protowire.DecodeBool(v)
+		case num == 15 && typ == protowire.BytesType:
+			m.value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return m, nil
+}
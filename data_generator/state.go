@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Device states. A device is Starting after boot, maintenance or being offline,
+// Fault while an alarm is active, and Running or Idle otherwise.
+const (
+	stateOffline     = "Offline"
+	stateStarting    = "Starting"
+	stateRunning     = "Running"
+	stateIdle        = "Idle"
+	stateMaintenance = "Maintenance"
+	stateFault       = "Fault"
+)
+
+// deviceStates lists the states by their Modbus state code
+var deviceStates = []string{stateOffline, stateStarting, stateRunning, stateIdle, stateMaintenance, stateFault}
+
+// stateCode returns the Modbus state code of a state, -1 for unknown states
+func stateCode(state string) int {
+	for i, s := range deviceStates {
+		if s == state {
+			return i
+		}
+	}
+	return -1
+}
+
+func knownState(state string) bool {
+	return stateCode(state) >= 0
+}
+
+// defaultStartup is how long a device stays Starting when its type has no startup_s
+const defaultStartup = 30 * time.Second
+
+// Alarm is an alarm raised on a device. It is listed until it is both cleared and acknowledged.
+type Alarm struct {
+	Code    int       `json:"code"`
+	Source  string    `json:"source"` // the metric or scenario that raised it
+	Message string    `json:"message"`
+	Raised  time.Time `json:"raised"`
+	Active  bool      `json:"active"` // the condition still holds
+	Acked   bool      `json:"acked"`
+}
+
+// alarmCondition raises an alarm for as long as it holds
+type alarmCondition struct {
+	code    int
+	source  string
+	message string
+}
+
+// alarmCodes returns the codes of the high and low alarm of the metric at index
+// in its device type: alarm_code and the next code, or 100 + 10 × index and the next
+func (m MetricSpec) alarmCodes(index int) (int, int) {
+	code := m.AlarmCode
+	if code == 0 {
+		code = 100 + 10*index
+	}
+	return code, code + 1
+}
+
+// updateState moves the device to its next state after a reading and puts the
+// state and alarms on the reading, d.mu must be held
+func (d *Device) updateState(data *OTData, effects scenarioEffects) {
+	now := data.Timestamp
+	conditions := effects.alarms
+	idle := false
+	for i, m := range d.metrics {
+		value, ok := data.Metrics[m.Name]
+		if !ok {
+			continue
+		}
+		high, low := m.alarmCodes(i)
+		if m.AlertAbove != nil && value > *m.AlertAbove {
+			conditions = append(conditions, alarmCondition{high, m.Name, fmt.Sprintf("%s high: %g above %g", m.Name, value, *m.AlertAbove)})
+		}
+		if m.AlertBelow != nil && value < *m.AlertBelow {
+			conditions = append(conditions, alarmCondition{low, m.Name, fmt.Sprintf("%s low: %g below %g", m.Name, value, *m.AlertBelow)})
+		}
+		if m.IdleBelow != nil && value < *m.IdleBelow {
+			idle = true
+		}
+	}
+	if effects.maintenance {
+		// Alarms are shelved while a device is under maintenance
+		conditions = nil
+	}
+	d.raiseAlarms(conditions, now)
+
+	next := stateRunning
+	switch {
+	case effects.maintenance:
+		next = stateMaintenance
+	case d.alarmCode() != 0:
+		next = stateFault
+	case d.state == "" || d.state == stateOffline || d.state == stateMaintenance:
+		next = stateStarting
+	case d.state == stateStarting && now.Sub(d.stateSince) < d.startup:
+		next = stateStarting
+	case idle:
+		next = stateIdle
+	}
+	d.setState(next, now)
+
+	data.Status = d.state
+	data.AlarmCode = d.alarmCode()
+	data.Alarms = d.alarmList()
+}
+
+// setState changes the state of the device, d.mu must be held
+func (d *Device) setState(state string, now time.Time) {
+	if d.state != state {
+		d.state = state
+		d.stateSince = now
+	}
+}
+
+// Offline reports whether a scenario takes the device offline at now, and marks it Offline if so
+func (d *Device) Offline(now time.Time) bool {
+	if !current().scenarios.Offline(d.ID, now) {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setState(stateOffline, now)
+	return true
+}
+
+// raiseAlarms raises an alarm for every condition that holds and clears the
+// others. Alarms that are cleared and acknowledged are dropped, d.mu must be held.
+func (d *Device) raiseAlarms(conditions []alarmCondition, now time.Time) {
+	holding := make(map[int]bool, len(conditions))
+	for _, c := range conditions {
+		holding[c.code] = true
+		a, ok := d.alarms[c.code]
+		if ok && a.Active {
+			continue
+		}
+		if !ok {
+			a = &Alarm{Code: c.code, Source: c.source}
+			d.alarms[c.code] = a
+		}
+		// An alarm that returns has to be acknowledged again
+		a.Message, a.Raised, a.Active, a.Acked = c.message, now, true, false
+	}
+
+	autoAck := time.Duration(current().config.Alarms.AutoAckS) * time.Second
+	for code, a := range d.alarms {
+		if !holding[code] {
+			a.Active = false
+		}
+		if !a.Acked && autoAck > 0 && now.Sub(a.Raised) >= autoAck {
+			a.Acked = true
+		}
+		if !a.Active && a.Acked {
+			delete(d.alarms, code)
+		}
+	}
+}
+
+// alarmCode returns the lowest code of the active alarms, 0 when none is active. d.mu must be held.
+func (d *Device) alarmCode() int {
+	code := 0
+	for c, a := range d.alarms {
+		if a.Active && (code == 0 || c < code) {
+			code = c
+		}
+	}
+	return code
+}
+
+// alarmList returns a copy of the alarms of the device by code, d.mu must be held
+func (d *Device) alarmList() []Alarm {
+	if len(d.alarms) == 0 {
+		return nil
+	}
+	alarms := make([]Alarm, 0, len(d.alarms))
+	for _, a := range d.alarms {
+		alarms = append(alarms, *a)
+	}
+	sort.Slice(alarms, func(i, j int) bool { return alarms[i].Code < alarms[j].Code })
+	return alarms
+}
+
+// Ack acknowledges an alarm of the device, or every alarm for code 0, and returns how many it acknowledged
+func (d *Device) Ack(code int, by string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var acked []int
+	for c, a := range d.alarms {
+		if (code == 0 || c == code) && !a.Acked {
+			a.Acked = true
+			acked = append(acked, c)
+			if !a.Active {
+				delete(d.alarms, c)
+			}
+		}
+	}
+	if len(acked) > 0 {
+		sort.Ints(acked)
+		log.Printf("Alarms %v of %s acknowledged via %s", acked, d.ID, by)
+		if d.last != nil {
+			// The last reading is shared with readers of the API, so it is replaced rather than changed
+			last := *d.last
+			last.Alarms = d.alarmList()
+			d.last = &last
+		}
+	}
+	return len(acked)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateCode(t *testing.T) {
+	tests := []struct {
+		state string
+		want  int
+	}{
+		{stateOffline, 0},
+		{stateStarting, 1},
+		{stateRunning, 2},
+		{stateIdle, 3},
+		{stateMaintenance, 4},
+		{stateFault, 5},
+		{"running", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		if got := stateCode(tt.state); got != tt.want {
+			t.Errorf("stateCode(%q) = %d, want %d", tt.state, got, tt.want)
+		}
+		if got := knownState(tt.state); got != (tt.want >= 0) {
+			t.Errorf("knownState(%q) = %v, want %v", tt.state, got, tt.want >= 0)
+		}
+	}
+}
+
+func TestAlarmCodes(t *testing.T) {
+	tests := []struct {
+		metric    MetricSpec
+		index     int
+		high, low int
+	}{
+		{MetricSpec{}, 0, 100, 101},
+		{MetricSpec{}, 3, 130, 131},
+		{MetricSpec{AlarmCode: 500}, 3, 500, 501},
+	}
+	for _, tt := range tests {
+		if high, low := tt.metric.alarmCodes(tt.index); high != tt.high || low != tt.low {
+			t.Errorf("alarmCodes(%d) = %d, %d, want %d, %d", tt.index, high, low, tt.high, tt.low)
+		}
+	}
+}
+
+// stateStep is one reading of a device, or an acknowledgement when ack is set
+type stateStep struct {
+	at          time.Duration // since the first reading
+	temperature float64
+	maintenance bool
+	scenario    []alarmCondition
+	ack         *int
+
+	state  string
+	code   int
+	alarms []Alarm // only code, active and acked are compared
+}
+
+func TestUpdateState(t *testing.T) {
+	ack := func(code int) *int { return &code }
+	alarm := func(code int, active, acked bool) Alarm { return Alarm{Code: code, Active: active, Acked: acked} }
+	overheat := []alarmCondition{{900, "overheat", "scenario"}}
+
+	tests := []struct {
+		name     string
+		autoAckS int
+		steps    []stateStep
+	}{
+		{
+			name: "starting until the startup time passed",
+			steps: []stateStep{
+				{at: 0, temperature: 50, state: stateStarting},
+				{at: 9 * time.Second, temperature: 50, state: stateStarting},
+				{at: 10 * time.Second, temperature: 50, state: stateRunning},
+			},
+		},
+		{
+			name: "idle below the idle threshold",
+			steps: []stateStep{
+				{at: 0, temperature: 5, state: stateStarting},
+				{at: 10 * time.Second, temperature: 5, state: stateIdle},
+				{at: 11 * time.Second, temperature: 50, state: stateRunning},
+			},
+		},
+		{
+			name: "fault clears back to running, the alarm stays listed until acknowledged",
+			steps: []stateStep{
+				{at: 0, temperature: 150, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, false)}},
+				{at: time.Second, temperature: 50, state: stateRunning, alarms: []Alarm{alarm(100, false, false)}},
+				{at: 2 * time.Second, ack: ack(100), alarms: nil},
+				{at: 3 * time.Second, temperature: 50, state: stateRunning},
+			},
+		},
+		{
+			name: "acknowledged alarm stays listed until cleared",
+			steps: []stateStep{
+				{at: 0, temperature: 150, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, false)}},
+				{at: time.Second, ack: ack(0), alarms: []Alarm{alarm(100, true, true)}},
+				{at: 2 * time.Second, temperature: 150, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, true)}},
+				{at: 3 * time.Second, temperature: 50, state: stateRunning},
+			},
+		},
+		{
+			name: "returning alarm has to be acknowledged again",
+			steps: []stateStep{
+				{at: 0, temperature: 150, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, false)}},
+				{at: time.Second, temperature: 50, state: stateRunning, alarms: []Alarm{alarm(100, false, false)}},
+				{at: 2 * time.Second, temperature: 150, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, false)}},
+			},
+		},
+		{
+			name: "ack of another code leaves the alarm",
+			steps: []stateStep{
+				{at: 0, temperature: -5, state: stateFault, code: 101, alarms: []Alarm{alarm(101, true, false)}},
+				{at: time.Second, ack: ack(100), alarms: []Alarm{alarm(101, true, false)}},
+			},
+		},
+		{
+			name: "lowest active code is the alarm code",
+			steps: []stateStep{
+				{at: 0, temperature: 150, scenario: overheat, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, false), alarm(900, true, false)}},
+				{at: time.Second, temperature: 50, scenario: overheat, state: stateFault, code: 900, alarms: []Alarm{alarm(100, false, false), alarm(900, true, false)}},
+			},
+		},
+		{
+			name: "maintenance shelves alarms",
+			steps: []stateStep{
+				{at: 0, temperature: 150, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, false)}},
+				{at: time.Second, temperature: 150, maintenance: true, state: stateMaintenance, alarms: []Alarm{alarm(100, false, false)}},
+				{at: 2 * time.Second, temperature: 50, state: stateStarting, alarms: []Alarm{alarm(100, false, false)}},
+			},
+		},
+		{
+			name:     "auto acknowledged after auto_ack_s",
+			autoAckS: 5,
+			steps: []stateStep{
+				{at: 0, temperature: 150, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, false)}},
+				{at: 4 * time.Second, temperature: 150, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, false)}},
+				{at: 5 * time.Second, temperature: 150, state: stateFault, code: 100, alarms: []Alarm{alarm(100, true, true)}},
+				{at: 6 * time.Second, temperature: 50, state: stateRunning},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			config.Alarms.AutoAckS = tt.autoAckS
+			running.Store(&snapshot{config: config})
+			t.Cleanup(func() { running.Store(nil) })
+
+			d := &Device{
+				ID: "BLR-01",
+				metrics: []MetricSpec{{
+					Name:       "temperature",
+					AlertAbove: float(100),
+					AlertBelow: float(0),
+					IdleBelow:  float(10),
+				}},
+				startup: 10 * time.Second,
+				alarms:  make(map[int]*Alarm),
+			}
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			for i, step := range tt.steps {
+				if step.ack != nil {
+					d.Ack(*step.ack, "test")
+					if got := compareAlarms(d.alarmList()); !reflect.DeepEqual(got, step.alarms) {
+						t.Errorf("step %d: alarms after ack = %+v, want %+v", i, got, step.alarms)
+					}
+					continue
+				}
+
+				data := OTData{Timestamp: start.Add(step.at), Metrics: map[string]float64{"temperature": step.temperature}}
+				d.updateState(&data, scenarioEffects{maintenance: step.maintenance, alarms: step.scenario})
+				if data.Status != step.state || data.AlarmCode != step.code {
+					t.Errorf("step %d: state %s with code %d, want %s with code %d", i, data.Status, data.AlarmCode, step.state, step.code)
+				}
+				if got := compareAlarms(data.Alarms); !reflect.DeepEqual(got, step.alarms) {
+					t.Errorf("step %d: alarms = %+v, want %+v", i, got, step.alarms)
+				}
+			}
+		})
+	}
+}
+
+// compareAlarms keeps the fields of alarms that TestUpdateState compares
+func compareAlarms(alarms []Alarm) []Alarm {
+	if len(alarms) == 0 {
+		return nil
+	}
+	kept := make([]Alarm, len(alarms))
+	for i, a := range alarms {
+		kept[i] = Alarm{Code: a.Code, Active: a.Active, Acked: a.Acked}
+	}
+	return kept
+}
+
+func TestAckCount(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		want int
+	}{
+		{"every alarm", 0, 2},
+		{"one alarm", 101, 1},
+		{"already acknowledged", 102, 0},
+		{"unknown code", 999, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Device{ID: "BLR-01", alarms: map[int]*Alarm{
+				100: {Code: 100, Active: true},
+				101: {Code: 101},
+				102: {Code: 102, Active: true, Acked: true},
+			}}
+			if got := d.Ack(tt.code, "test"); got != tt.want {
+				t.Errorf("Ack(%d) = %d, want %d", tt.code, got, tt.want)
+			}
+			if _, listed := d.alarms[101]; listed == (tt.code == 0 || tt.code == 101) {
+				t.Errorf("Ack(%d): cleared alarm 101 listed = %v", tt.code, listed)
+			}
+		})
+	}
+}
+
+func TestAckReplacesLastReading(t *testing.T) {
+	last := &OTData{Alarms: []Alarm{{Code: 100, Active: true}}}
+	d := &Device{ID: "BLR-01", last: last, alarms: map[int]*Alarm{100: {Code: 100, Active: true}}}
+	d.Ack(100, "test")
+	if last.Alarms[0].Acked {
+		t.Error("Ack changed the reading readers may hold")
+	}
+	if len(d.last.Alarms) != 1 || !d.last.Alarms[0].Acked {
+		t.Errorf("last reading alarms = %+v, want 100 acknowledged", d.last.Alarms)
+	}
+}
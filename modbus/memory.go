@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Most registers and coils a single read may ask for
+const (
+	maxReadRegisters = 125
+	maxReadCoils     = 2000
+)
+
+// maxUnits caps the units that get memory of their own. A unit takes 136 KiB,
+// so writes sweeping every unit id cannot grow the honeypot past a few MB.
+const maxUnits = 16
+
+// unitMemory is every register and coil of one unit, coils packed 64 to a word
+type unitMemory struct {
+	registers [1 << 16]uint16
+	coils     [1 << 16 / 64]uint64
+}
+
+// memory holds the registers and coils written to the honeypot by unit, so
+// reads return what the data generator, or an attacker, wrote like a real PLC.
+// Points nobody wrote, and writes to units past maxUnits, read as zero.
+type memory struct {
+	mu    sync.Mutex
+	units map[byte]*unitMemory
+}
+
+var plc = &memory{units: make(map[byte]*unitMemory)}
+
+// unit returns the memory of a unit, allocating it on the first write while
+// there is room. It is nil for a unit that has none, m.mu must be held.
+func (m *memory) unit(id byte, write bool) *unitMemory {
+	u, ok := m.units[id]
+	if !ok && write && len(m.units) < maxUnits {
+		u = &unitMemory{}
+		m.units[id] = u
+	}
+	return u
+}
+
+func (m *memory) writeRegisters(unit byte, address uint16, values []uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.unit(unit, true)
+	if u == nil {
+		return
+	}
+	for i, v := range values {
+		u.registers[address+uint16(i)] = v
+	}
+}
+
+func (m *memory) writeCoils(unit byte, address uint16, values []bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.unit(unit, true)
+	if u == nil {
+		return
+	}
+	for i, v := range values {
+		a := address + uint16(i)
+		if v {
+			u.coils[a/64] |= 1 << (a % 64)
+		} else {
+			u.coils[a/64] &^= 1 << (a % 64)
+		}
+	}
+}
+
+// readRegisters returns quantity registers from address as bytes, high byte first
+func (m *memory) readRegisters(unit byte, address, quantity uint16) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := make([]byte, 2*int(quantity))
+	u := m.unit(unit, false)
+	if u == nil {
+		return data
+	}
+	for i := 0; i < int(quantity); i++ {
+		binary.BigEndian.PutUint16(data[2*i:], u.registers[address+uint16(i)])
+	}
+	return data
+}
+
+// readCoils returns quantity coils from address packed eight to a byte, lowest address in the lowest bit
+func (m *memory) readCoils(unit byte, address, quantity uint16) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := make([]byte, (int(quantity)+7)/8)
+	u := m.unit(unit, false)
+	if u == nil {
+		return data
+	}
+	for i := 0; i < int(quantity); i++ {
+		a := address + uint16(i)
+		if u.coils[a/64]&(1<<(a%64)) != 0 {
+			data[i/8] |= 1 << (i % 8)
+		}
+	}
+	return data
+}
+
+// readResponse builds the answer to a read request: the MBAP header of the
+// request with the new length, the unit, the function, a byte count and data
+func readResponse(request []byte, data []byte) []byte {
+	response := make([]byte, 9, 9+len(data))
+	copy(response, request[:8])
+	binary.BigEndian.PutUint16(response[4:6], uint16(3+len(data)))
+	response[8] = byte(len(data))
+	return append(response, data...)
+}
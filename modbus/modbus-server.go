@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/binary"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -8,7 +10,11 @@ import (
 	"os"
 )
 
+var registerMapPath = flag.String("registers", "registers.json", "Register map shared with the data generator, used to name the points requests touch")
+
 func main() {
+	flag.Parse()
+
 	// Create a logs directory if it doesn't exist
 	err := os.MkdirAll("/logs", 0777)
 	if err != nil {
@@ -28,6 +34,11 @@ func main() {
 	multiWriter := io.MultiWriter(os.Stdout, logFile)
 	log.SetOutput(multiWriter)
 
+	// The register map is optional, without it requests are logged without point names
+	if err := loadRegisterMaps(*registerMapPath); err != nil {
+		log.Printf("Register map not loaded: %v", err)
+	}
+
 	// Create a TCP listener
 	listener, err := net.Listen("tcp", "0.0.0.0:502")
 	if err != nil {
@@ -65,6 +76,7 @@ func handleConnection(conn net.Conn) {
 			}
 		}
 		log.Printf("Received data from %s: %x\n", originIP, data[:n])
+		logRequests(originIP, data[:n])
 
 		// Process the received data
 		response := processData(data[:n])
@@ -79,7 +91,88 @@ func handleConnection(conn net.Conn) {
 }
 
 func processData(data []byte) []byte {
-	// Implement your data processing logic here
-	// For demonstration, let's just return the received data as-is
+	if len(data) < 12 {
+		return data
+	}
+	unit, function := data[6], data[7]
+	address := binary.BigEndian.Uint16(data[8:10])
+	word := binary.BigEndian.Uint16(data[10:12]) // quantity, or the value of a single write
+
+	switch function {
+	case 1, 2: // read coils, read discrete inputs
+		if word > 0 && word <= maxReadCoils {
+			return readResponse(data, plc.readCoils(unit, address, word))
+		}
+	case 3, 4: // read holding registers, read input registers
+		if word > 0 && word <= maxReadRegisters {
+			return readResponse(data, plc.readRegisters(unit, address, word))
+		}
+	case 5: // write single coil
+		plc.writeCoils(unit, address, []bool{word == 0xFF00})
+	case 6: // write single register
+		plc.writeRegisters(unit, address, []uint16{word})
+	case 15: // write multiple coils
+		if len(data) >= 13+(int(word)+7)/8 {
+			values := make([]bool, word)
+			for i := range values {
+				values[i] = data[13+i/8]&(1<<(i%8)) != 0
+			}
+			plc.writeCoils(unit, address, values)
+		}
+	case 16: // write multiple registers
+		if len(data) >= 13+2*int(word) {
+			values := make([]uint16, word)
+			for i := range values {
+				values[i] = binary.BigEndian.Uint16(data[13+2*i:])
+			}
+			plc.writeRegisters(unit, address, values)
+		}
+	}
+
+	// Acknowledge multiple coil and register writes the way a PLC does, with the
+	// MBAP header, function code, address and quantity, so writers see success
+	if function == 15 || function == 16 {
+		response := append([]byte(nil), data[:12]...)
+		binary.BigEndian.PutUint16(response[4:6], 6)
+		return response
+	}
+
+	// Everything else is returned as-is, which is also the correct answer to single writes
 	return data
 }
+
+// logRequests decodes the Modbus TCP requests in a packet and logs which
+// function, addresses and decoy points each of them targets
+func logRequests(originIP string, data []byte) {
+	for len(data) >= 8 {
+		// MBAP header: transaction id, protocol id, length (unit id + PDU), unit id
+		length := int(binary.BigEndian.Uint16(data[4:6]))
+		if length < 2 || len(data) < 6+length {
+			return
+		}
+		unit := data[6]
+		pdu := data[7 : 6+length]
+		data = data[6+length:]
+
+		function := pdu[0]
+		if len(pdu) < 5 {
+			log.Printf("Modbus request from %s: unit=%d function=%d", originIP, unit, function)
+			continue
+		}
+		address := binary.BigEndian.Uint16(pdu[1:3])
+		quantity := binary.BigEndian.Uint16(pdu[3:5])
+
+		switch function {
+		case 1, 15: // read coils, write multiple coils
+			log.Printf("Modbus request from %s: unit=%d function=%d coils=%d+%d points=%s", originIP, unit, function, address, quantity, pointsAt(unit, true, address, quantity))
+		case 5: // write single coil, the second word is the value
+			log.Printf("Modbus request from %s: unit=%d function=%d coil=%d value=%#04x points=%s", originIP, unit, function, address, quantity, pointsAt(unit, true, address, 1))
+		case 3, 4, 16: // read holding/input registers, write multiple registers
+			log.Printf("Modbus request from %s: unit=%d function=%d registers=%d+%d points=%s", originIP, unit, function, address, quantity, pointsAt(unit, false, address, quantity))
+		case 6: // write single register, the second word is the value
+			log.Printf("Modbus request from %s: unit=%d function=%d register=%d value=%d points=%s", originIP, unit, function, address, quantity, pointsAt(unit, false, address, 1))
+		default:
+			log.Printf("Modbus request from %s: unit=%d function=%d", originIP, unit, function)
+		}
+	}
+}
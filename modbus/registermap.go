@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// registerPoint and coilPoint mirror the register map the data generator writes with
+type registerPoint struct {
+	Name    string `json:"name"`
+	Address uint16 `json:"address"`
+	Type    string `json:"type"`
+	Length  int    `json:"length"` // registers of a string
+}
+
+type coilPoint struct {
+	Name    string `json:"name"`
+	Address uint16 `json:"address"`
+}
+
+type registerMap struct {
+	UnitID    byte            `json:"unit_id"`
+	Registers []registerPoint `json:"registers"`
+	Coils     []coilPoint     `json:"coils"`
+}
+
+// registerMaps holds the layout of every decoy device, keyed by device id
+var registerMaps map[string]registerMap
+
+// loadRegisterMaps reads the register map shared with the data generator
+func loadRegisterMaps(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read register map: %v", err)
+	}
+	maps := make(map[string]registerMap)
+	if err := json.Unmarshal(data, &maps); err != nil {
+		return fmt.Errorf("could not parse register map: %v", err)
+	}
+	for id, m := range maps {
+		if m.UnitID == 0 {
+			m.UnitID = 1
+			maps[id] = m
+		}
+	}
+	registerMaps = maps
+	return nil
+}
+
+// pointsAt names the points of the decoy devices that a request for
+// quantity registers or coils from address on a unit touches
+func pointsAt(unit byte, coils bool, address, quantity uint16) string {
+	end := uint32(address) + uint32(quantity)
+	overlaps := func(start uint16, width int) bool {
+		return uint32(start) < end && uint32(start)+uint32(width) > uint32(address)
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for id, m := range registerMaps {
+		if m.UnitID != unit {
+			continue
+		}
+		if coils {
+			for _, c := range m.Coils {
+				if overlaps(c.Address, 1) {
+					add(id + "/" + c.Name)
+				}
+			}
+			continue
+		}
+		for _, r := range m.Registers {
+			width := 1
+			if r.Type == "int32" || r.Type == "uint32" || r.Type == "float32" {
+				width = 2
+			} else if r.Type == "string" {
+				width = r.Length
+			}
+			if overlaps(r.Address, width) {
+				add(id + "/" + r.Name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}